@@ -0,0 +1,335 @@
+// Copyright 2014 Joshua Marsh. All rights reserved. Use of this
+// source code is governed by the MIT license that can be found in the
+// LICENSE file.
+
+package wrapio
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// The AEAD stream format is a header followed by segments:
+//
+//	header:  "WIOA" | version (1) | segment size (4, big endian) | nonce prefix
+//	segment: Seal(nonce prefix | counter (4, big endian) | final (1), plain text)
+//
+// Every segment but the last holds exactly segment size bytes of
+// plain text. The last one holds whatever is left, which may be
+// nothing, and is the only one sealed with the final byte set to 1.
+// The header is the additional data for every segment. This follows
+// the STREAM construction from "Online Authenticated-Encryption and
+// its Nonce-Reuse Misuse-Resistance" by Hoang, Reyhanitabar, Rogaway
+// and Vizár, so segments can't be reordered, dropped or truncated
+// without it being noticed.
+const (
+	aeadMagic       = "WIOA"
+	aeadVersion     = 1
+	aeadSegmentSize = 64 * 1024
+	// aeadMaxSegmentSize limits what we'll allocate for a header we
+	// haven't authenticated yet.
+	aeadMaxSegmentSize = 16 * 1024 * 1024
+	// aeadNonceSuffix is the counter and the final flag.
+	aeadNonceSuffix = 5
+	// aeadMinNonceSize leaves room for at least a 7 byte random
+	// prefix.
+	aeadMinNonceSize = 12
+)
+
+var (
+	// ErrInvalidHeader is returned when an AEAD stream doesn't start
+	// with a header we understand.
+	ErrInvalidHeader = errors.New("wrapio: invalid stream header")
+
+	// ErrTruncated is returned when an AEAD stream ends before its
+	// final segment.
+	ErrTruncated = errors.New("wrapio: stream truncated")
+
+	// ErrAuthFailed is returned when data fails to authenticate.
+	ErrAuthFailed = errors.New("wrapio: message authentication failed")
+
+	// errTooManySegments is returned when the segment counter would
+	// wrap around and reuse a nonce.
+	errTooManySegments = errors.New("wrapio: too many segments in stream")
+)
+
+// randReader is where nonce prefixes come from. Tests can replace it.
+var randReader io.Reader = rand.Reader
+
+// aeadNonce fills in the counter and final flag of the nonce.
+func aeadNonce(nonce []byte, counter uint32, final bool) {
+	l := len(nonce)
+	binary.BigEndian.PutUint32(nonce[l-aeadNonceSuffix:], counter)
+	nonce[l-1] = 0
+	if final {
+		nonce[l-1] = 1
+	}
+}
+
+// AEADWriter implements the io.Closer and io.Writer interface.
+type aeadWriter struct {
+	aead    cipher.AEAD
+	w       io.Writer
+	block   io.WriteCloser
+	last    io.WriteCloser
+	header  []byte
+	nonce   []byte
+	counter uint32
+	final   bool // Set by the last func writer's handler.
+	out     []byte
+	err     error
+}
+
+// start writes out the header. It's done on the first call to Write
+// or Close so the constructor can't fail.
+func (a *aeadWriter) start() error {
+	if a.header != nil || a.err != nil {
+		return a.err
+	}
+	ns := a.aead.NonceSize()
+	h := make([]byte, 0, 9+ns-aeadNonceSuffix)
+	h = append(h, aeadMagic...)
+	h = append(h, aeadVersion)
+	h = binary.BigEndian.AppendUint32(h, aeadSegmentSize)
+	prefix := make([]byte, ns-aeadNonceSuffix)
+	if _, err := io.ReadFull(randReader, prefix); err != nil {
+		a.err = err
+		return err
+	}
+	h = append(h, prefix...)
+	a.nonce = make([]byte, ns)
+	copy(a.nonce, prefix)
+	if _, err := a.w.Write(h); err != nil {
+		a.err = err
+		return err
+	}
+	a.header = h
+	return nil
+}
+
+// seal is the writer below the last func writer. It gets whole
+// segments, straight from the caller's slice when they fit, except
+// for the final chunk, which is at most one segment.
+func (a *aeadWriter) seal(p []byte) (int, error) {
+	if a.err != nil {
+		return 0, a.err
+	}
+	final := a.final
+	if len(p) == 0 && !final {
+		return 0, nil
+	}
+	for x := 0; ; x += aeadSegmentSize {
+		end := x + aeadSegmentSize
+		if end > len(p) {
+			end = len(p)
+		}
+		if a.counter == ^uint32(0) {
+			a.err = errTooManySegments
+			return x, a.err
+		}
+		aeadNonce(a.nonce, a.counter, final && end == len(p))
+		a.out = a.aead.Seal(a.out[:0], a.nonce, p[x:end], a.header)
+		a.counter++
+		if _, err := a.w.Write(a.out); err != nil {
+			a.err = err
+			return x, err
+		}
+		if end == len(p) {
+			return len(p), nil
+		}
+	}
+}
+
+// Write implements the io.Writer interface.
+func (a *aeadWriter) Write(p []byte) (int, error) {
+	if err := a.start(); err != nil {
+		return 0, err
+	}
+	return a.block.Write(p)
+}
+
+// Close implements the io.Closer interface.
+func (a *aeadWriter) Close() error {
+	if err := a.start(); err != nil {
+		return err
+	}
+	if err := a.block.Close(); err != nil {
+		return err
+	}
+	// The last func writer runs its handler even on an empty stream,
+	// since we still need a final segment to mark the end.
+	return a.last.Close()
+}
+
+// NewAEADWriter returns an io.Writer that encrypts and authenticates
+// everything written to it in segments with the given cipher.AEAD and
+// sends the results to the given io.Writer. The header is written on
+// the first Write() or Close(). It is built from NewBlockWriter, which
+// cuts the data into segments, and NewLastFuncWriter, which finds the
+// final one.
+//
+// The nonce size of the AEAD must be at least 12 bytes. A random
+// prefix makes up all but the last 5 bytes of each nonce and a stream
+// is only safe as long as no other stream with the same key gets the
+// same prefix. With 12 byte nonces, like AES-GCM's, the prefix is only
+// 7 bytes, so a single key shouldn't be used for more than a few
+// thousand streams. That keeps the chance of a repeat below 2^-32.
+// Longer nonces, like XChaCha20-Poly1305's 24 bytes, allow far more.
+// Use a fresh key for each stream if you can.
+//
+// Because it is impossible to tell when writing is completed, the
+// returned writer is also a closer. The close operation must be called
+// to write the final segment, without which the stream won't decrypt.
+// It does not close the given io.Writer. If either of the parameters
+// are nil or the nonce size is too small, nil is returned.
+func NewAEADWriter(aead cipher.AEAD, w io.Writer) io.WriteCloser {
+	if aead == nil || w == nil || aead.NonceSize() < aeadMinNonceSize {
+		return nil
+	}
+	a := &aeadWriter{aead: aead, w: w}
+	a.last = NewLastFuncWriter(func(p []byte) []byte {
+		a.final = true
+		return p
+	}, writerFunc(a.seal), LastRunOnEmpty(), LastHoldBack(aeadSegmentSize))
+	a.block = NewBlockWriter(aeadSegmentSize, a.last, BlockPassThrough())
+	return a
+}
+
+// writerFunc turns a function into an io.Writer.
+type writerFunc func([]byte) (int, error)
+
+// Write implements the io.Writer interface.
+func (w writerFunc) Write(p []byte) (int, error) {
+	return w(p)
+}
+
+// AEADReader implements the io.Reader interface.
+type aeadReader struct {
+	aead    cipher.AEAD
+	r       io.Reader
+	last    io.Reader
+	header  []byte
+	nonce   []byte
+	counter uint32
+	final   bool   // Set by the last func reader's handler.
+	done    bool   // Set once the final segment is opened.
+	buf     []byte // Where we read each sealed segment.
+	plain   []byte // Where we open each segment.
+	out     []byte // Plain text that hasn't been returned yet.
+	err     error
+}
+
+// start reads the header and sets up the segment readers.
+func (a *aeadReader) start() error {
+	ns := a.aead.NonceSize()
+	h := make([]byte, 9+ns-aeadNonceSuffix)
+	if _, err := io.ReadFull(a.r, h); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrInvalidHeader
+		}
+		return err
+	}
+	size := binary.BigEndian.Uint32(h[5:9])
+	if string(h[:4]) != aeadMagic || h[4] != aeadVersion || size == 0 ||
+		size > aeadMaxSegmentSize {
+		return ErrInvalidHeader
+	}
+	a.header = h
+	a.nonce = make([]byte, ns)
+	copy(a.nonce, h[9:])
+	segment := int(size) + a.aead.Overhead()
+	a.buf = make([]byte, segment)
+	a.plain = make([]byte, 0, size)
+	a.last = NewLastFuncReader(func(p []byte) []byte {
+		a.final = true
+		return p
+	}, NewBlockReader(segment, a.r))
+	return nil
+}
+
+// open authenticates and decrypts the next segment into out.
+func (a *aeadReader) open(segment []byte, final bool) error {
+	aeadNonce(a.nonce, a.counter, final)
+	out, err := a.aead.Open(a.plain[:0], a.nonce, segment, a.header)
+	if err != nil {
+		if final {
+			// If it opens as a middle segment, the ones after it were
+			// cut off.
+			aeadNonce(a.nonce, a.counter, false)
+			if _, err := a.aead.Open(a.plain[:0], a.nonce, segment, a.header); err == nil {
+				return ErrTruncated
+			}
+		}
+		return ErrAuthFailed
+	}
+	a.counter++
+	a.out = out
+	a.done = final
+	return nil
+}
+
+// Read implements the io.Reader interface.
+func (a *aeadReader) Read(p []byte) (int, error) {
+	for len(a.out) == 0 {
+		if a.err != nil {
+			return 0, a.err
+		}
+		if a.header == nil {
+			if a.err = a.start(); a.err != nil {
+				return 0, a.err
+			}
+		}
+		// We always read a whole segment so the last func reader sees
+		// the same size every time.
+		n, err := a.last.Read(a.buf)
+		// The handler runs on any error, but only io.EOF means this is
+		// really the last segment.
+		final := a.final && err == io.EOF
+		if n > 0 {
+			if a.err = a.open(a.buf[:n], final); a.err != nil {
+				if err != nil && err != io.EOF {
+					// The segment was likely cut short by the error.
+					a.err = err
+				}
+				return 0, a.err
+			}
+		}
+		if err == io.EOF && !a.done {
+			err = ErrTruncated
+		}
+		a.err = err
+		if n == 0 && err == nil {
+			// The reader gave us nothing. We'll try again next time.
+			return 0, nil
+		}
+	}
+	n := copy(p, a.out)
+	a.out = a.out[n:]
+	if len(a.out) == 0 && a.err != nil {
+		return n, a.err
+	}
+	return n, nil
+}
+
+// NewAEADReader returns an io.Reader that decrypts and authenticates
+// a stream made by NewAEADWriter using the given cipher.AEAD. It is
+// built from NewBlockReader, which finds the segment boundaries, and
+// NewLastFuncReader, which finds the final segment.
+//
+// Each segment is authenticated before any of it is returned. If a
+// segment fails, ErrAuthFailed is returned. If the stream ends before
+// the final segment, ErrTruncated is returned in place of io.EOF. If
+// the header can't be read, ErrInvalidHeader is returned. Any other
+// error from the given reader is returned as is once the segments
+// before it have been. None of these errors are recoverable. If either
+// of the parameters are nil or the nonce size is too small, nil is
+// returned.
+func NewAEADReader(aead cipher.AEAD, r io.Reader) io.Reader {
+	if aead == nil || r == nil || aead.NonceSize() < aeadMinNonceSize {
+		return nil
+	}
+	return &aeadReader{aead: aead, r: r}
+}
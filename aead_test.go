@@ -0,0 +1,207 @@
+// Copyright 2014 Joshua Marsh. All rights reserved. Use of this
+// source code is governed by the MIT license that can be found in the
+// LICENSE file.
+
+package wrapio
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"testing"
+	"testing/iotest"
+)
+
+func newGCM(t *testing.T) cipher.AEAD {
+	b, err := aes.NewCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatalf("failed to make aes cipher: %v", err)
+	}
+	g, err := cipher.NewGCM(b)
+	if err != nil {
+		t.Fatalf("failed to make gcm: %v", err)
+	}
+	return g
+}
+
+// sealStream encrypts data with writes of the given size.
+func sealStream(t *testing.T, a cipher.AEAD, data []byte, chunk int) []byte {
+	buf := &bytes.Buffer{}
+	w := NewAEADWriter(a, buf)
+	for x := 0; x < len(data); x += chunk {
+		end := x + chunk
+		if end > len(data) {
+			end = len(data)
+		}
+		if n, err := w.Write(data[x:end]); n != end-x || err != nil {
+			t.Fatalf("write returned %v %v", n, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close returned %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestAEAD(t *testing.T) {
+	a := newGCM(t)
+	header := 9 + a.NonceSize() - aeadNonceSuffix
+	S := aeadSegmentSize
+	for _, l := range []int{0, 1, S - 1, S, S + 1, 3 * S} {
+		data := make([]byte, l)
+		for x := range data {
+			data[x] = byte(x)
+		}
+		for _, chunk := range []int{1000, S, 5 * S} {
+			ct := sealStream(t, a, data, chunk)
+			// A full last segment is the final one.
+			segments := (l + S - 1) / S
+			if segments == 0 {
+				segments = 1
+			}
+			if expected := header + l + segments*a.Overhead(); len(ct) != expected {
+				t.Errorf("len %v, chunk %v: cipher text is %v bytes, expected %v",
+					l, chunk, len(ct), expected)
+			}
+			for _, lp := range []int{7, 4096, 2 * S} {
+				r := NewAEADReader(a, iotest.HalfReader(bytes.NewReader(ct)))
+				pt := &bytes.Buffer{}
+				p := make([]byte, lp)
+				var err error
+				for err == nil {
+					var n int
+					n, err = r.Read(p)
+					pt.Write(p[:n])
+				}
+				if err != io.EOF || !bytes.Equal(pt.Bytes(), data) {
+					t.Errorf("len %v, chunk %v, len(p) %v: read %v bytes, %v",
+						l, chunk, lp, pt.Len(), err)
+				}
+			}
+		}
+	}
+}
+
+func TestAEADReaderErrors(t *testing.T) {
+	a := newGCM(t)
+	header := 9 + a.NonceSize() - aeadNonceSuffix
+	seg := aeadSegmentSize + a.Overhead()
+	data := bytes.Repeat([]byte("x"), 2*aeadSegmentSize+10)
+	ct := sealStream(t, a, data, 4096)
+	flip := func(i int) []byte {
+		c := append([]byte(nil), ct...)
+		c[i] ^= 1
+		return c
+	}
+	swapped := append([]byte(nil), ct[:header]...)
+	swapped = append(swapped, ct[header+seg:header+2*seg]...)
+	swapped = append(swapped, ct[header:header+seg]...)
+	swapped = append(swapped, ct[header+2*seg:]...)
+	empty := sealStream(t, a, nil, 1)
+	tests := []struct {
+		ct  []byte
+		err error
+	}{
+		{ct: ct[:3], err: ErrInvalidHeader},
+		{ct: flip(0), err: ErrInvalidHeader},
+		{ct: flip(header - 1), err: ErrAuthFailed},
+		{ct: flip(header + 5), err: ErrAuthFailed},
+		{ct: flip(len(ct) - 1), err: ErrAuthFailed},
+		{ct: swapped, err: ErrAuthFailed},
+		{ct: ct[:header], err: ErrTruncated},
+		{ct: ct[:header+seg], err: ErrTruncated},
+		{ct: ct[:header+2*seg], err: ErrTruncated},
+		{ct: ct[:len(ct)-1], err: ErrAuthFailed},
+		{ct: append(append([]byte(nil), ct...), empty[header:]...), err: ErrAuthFailed},
+	}
+	for k, test := range tests {
+		r := NewAEADReader(a, bytes.NewReader(test.ct))
+		_, err := ioutil.ReadAll(r)
+		if err != test.err {
+			t.Errorf("Test %v: err (%v) != expected (%v)", k, err, test.err)
+		}
+		// Errors stick.
+		if _, err := r.Read(make([]byte, 1)); err != test.err {
+			t.Errorf("Test %v: second err (%v) != expected (%v)", k, err, test.err)
+		}
+	}
+	// Errors from the reader are passed along once the whole segments
+	// before them are returned.
+	e := errors.New("net down")
+	for k, cut := range []int{header + 2*seg, header + seg + 10} {
+		r := NewAEADReader(a, io.MultiReader(bytes.NewReader(ct[:cut]),
+			iotest.ErrReader(e)))
+		got, err := ioutil.ReadAll(r)
+		if err != e {
+			t.Errorf("Reader error %v: err (%v) != expected (%v)", k, err, e)
+		}
+		if !bytes.Equal(got, data[:len(got)]) || len(got)%aeadSegmentSize != 0 {
+			t.Errorf("Reader error %v: got %v bytes of bad data", k, len(got))
+		}
+	}
+	// Test the special error cases.
+	if NewAEADReader(nil, bytes.NewReader(ct)) != nil {
+		t.Errorf("nil aead didn't return nil.")
+	}
+	if NewAEADReader(a, nil) != nil {
+		t.Errorf("nil io.Reader didn't return nil.")
+	}
+	if NewAEADWriter(nil, ioutil.Discard) != nil {
+		t.Errorf("nil aead didn't return nil.")
+	}
+	if NewAEADWriter(a, nil) != nil {
+		t.Errorf("nil io.Writer didn't return nil.")
+	}
+	b, _ := aes.NewCipher(make([]byte, 16))
+	short, _ := cipher.NewGCMWithNonceSize(b, 8)
+	if NewAEADWriter(short, ioutil.Discard) != nil {
+		t.Errorf("short nonce didn't return nil.")
+	}
+}
+
+func TestAEADWriterLargeWrite(t *testing.T) {
+	a := newGCM(t)
+	data := make([]byte, 64*aeadSegmentSize+10)
+	buf := &bytes.Buffer{}
+	buf.Grow(len(data) + 65*a.Overhead() + 100)
+	w := NewAEADWriter(a, buf)
+	// Only the final segment should be held, so a large write doesn't
+	// get copied.
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	w.Write(data)
+	runtime.ReadMemStats(&after)
+	if d := after.TotalAlloc - before.TotalAlloc; d > 4*aeadSegmentSize {
+		t.Errorf("a %v byte write allocated %v bytes", len(data), d)
+	}
+	w.Close()
+	pt, err := ioutil.ReadAll(NewAEADReader(a, buf))
+	if err != nil || !bytes.Equal(pt, data) {
+		t.Errorf("read back %v bytes, %v", len(pt), err)
+	}
+}
+
+func TestAEADWriterErrors(t *testing.T) {
+	a := newGCM(t)
+	// A failing random source.
+	old := randReader
+	randReader = er{err: io.ErrUnexpectedEOF}
+	w := NewAEADWriter(a, ioutil.Discard)
+	if _, err := w.Write([]byte("x")); err != io.ErrUnexpectedEOF {
+		t.Errorf("random failure wasn't returned: %v", err)
+	}
+	randReader = old
+	// A failing writer.
+	e := ew{err: io.ErrShortWrite}
+	w = NewAEADWriter(a, e)
+	if _, err := w.Write([]byte("x")); err != io.ErrShortWrite {
+		t.Errorf("write failure wasn't returned: %v", err)
+	}
+	if err := w.Close(); err != io.ErrShortWrite {
+		t.Errorf("write failure wasn't returned from close: %v", err)
+	}
+}
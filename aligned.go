@@ -0,0 +1,186 @@
+// Copyright 2014 Joshua Marsh. All rights reserved. Use of this
+// source code is governed by the MIT license that can be found in the
+// LICENSE file.
+
+package wrapio
+
+import (
+	"io"
+	"os"
+	"unsafe"
+)
+
+// alignedBufferSize is roughly how much the aligned reader and writer
+// buffer. It's rounded up to a multiple of the sector size.
+const alignedBufferSize = 1024 * 1024
+
+// AlignedBuffer returns a slice of length n whose first byte is on a
+// page boundary. Files opened with O_DIRECT on Linux need buffers like
+// this.
+func AlignedBuffer(n int) []byte {
+	align := os.Getpagesize()
+	b := make([]byte, n+align)
+	off := 0
+	if r := int(uintptr(unsafe.Pointer(&b[0])) & uintptr(align-1)); r != 0 {
+		off = align - r
+	}
+	return b[off : off+n : off+n]
+}
+
+// newAlignedBuffer returns a page aligned buffer that is a multiple of
+// the sector size.
+func newAlignedBuffer(sector int) []byte {
+	return AlignedBuffer(((alignedBufferSize + sector - 1) / sector) * sector)
+}
+
+// Aligned implements the io.Closer, io.Reader, and io.Writer
+// interface.
+type aligned struct {
+	r      io.Reader
+	w      io.Writer
+	sector int
+	buf    []byte // Page aligned and a multiple of sector long.
+	off    int    // Where the unread data starts in buf.
+	end    int    // Where the unread or unwritten data ends in buf.
+	err    error
+	start  int64 // The offset of w when we started writing.
+	total  int64 // The bytes we've been given to write.
+	begun  bool
+	closed bool
+}
+
+// Read implements the io.Reader interface.
+func (a *aligned) Read(p []byte) (int, error) {
+	if a.off == a.end {
+		if a.err != nil {
+			return 0, a.err
+		}
+		if a.buf == nil {
+			a.buf = newAlignedBuffer(a.sector)
+		}
+		// We always ask for the whole buffer. Only the end of the data
+		// should come back short.
+		n, err := a.r.Read(a.buf)
+		a.off, a.end, a.err = 0, n, err
+		if n == 0 {
+			return 0, err
+		}
+	}
+	n := copy(p, a.buf[a.off:a.end])
+	a.off += n
+	return n, nil
+}
+
+// flush writes out the whole sectors in the buffer. It assumes there
+// are only whole sectors in it.
+func (a *aligned) flush() error {
+	if a.end == 0 {
+		return nil
+	}
+	_, err := a.w.Write(a.buf[:a.end])
+	a.end = 0
+	if err != nil {
+		a.err = err
+	}
+	return err
+}
+
+// Write implements the io.Writer interface.
+func (a *aligned) Write(p []byte) (int, error) {
+	if a.closed {
+		return 0, ErrClosed
+	}
+	if a.err != nil {
+		return 0, a.err
+	}
+	if !a.begun {
+		// Remember where we started so Close() knows where to
+		// truncate.
+		a.begun = true
+		if s, ok := a.w.(io.Seeker); ok {
+			if off, err := s.Seek(0, io.SeekCurrent); err == nil {
+				a.start = off
+			}
+		}
+		a.buf = newAlignedBuffer(a.sector)
+	}
+	written := 0
+	for written < len(p) {
+		n := copy(a.buf[a.end:], p[written:])
+		a.end += n
+		if a.end == len(a.buf) {
+			// Anything held in the buffer is lost on an error, so we
+			// only count what came before it.
+			if err := a.flush(); err != nil {
+				return written, err
+			}
+		}
+		written += n
+		a.total += int64(n)
+	}
+	return written, nil
+}
+
+// Close implements the io.Closer interface.
+func (a *aligned) Close() error {
+	if a.closed {
+		return a.err
+	}
+	a.closed = true
+	if a.err != nil || a.end == 0 {
+		return a.err
+	}
+	// Pad the last sector with zeros, write it and then cut the zeros
+	// back off.
+	l := ((a.end + a.sector - 1) / a.sector) * a.sector
+	padded := l != a.end
+	for x := a.end; x < l; x++ {
+		a.buf[x] = 0
+	}
+	a.end = l
+	if err := a.flush(); err != nil {
+		return err
+	}
+	if t, ok := a.w.(interface{ Truncate(int64) error }); ok && padded {
+		a.err = t.Truncate(a.start + a.total)
+	}
+	return a.err
+}
+
+// NewAlignedReader returns a reader that reads from the given reader
+// into a page aligned buffer in whole multiples of size, which should
+// be the sector size. This makes it suitable for files opened with
+// O_DIRECT on Linux. The data is copied out of the buffer to fill p,
+// so p can be any size. If the given reader is nil or the size is less
+// than 1, nil is returned.
+func NewAlignedReader(size int, r io.Reader) io.Reader {
+	if r == nil || size < 1 {
+		return nil
+	}
+	return &aligned{r: r, sector: size}
+}
+
+// NewAlignedWriter returns a writer that copies the data written to
+// it into a page aligned buffer and writes it to the given writer in
+// whole multiples of size, which should be the sector size. This makes
+// it suitable for files opened with O_DIRECT on Linux. Unlike
+// NewBlockWriter, the data is always copied since the memory has to
+// be aligned as well.
+//
+// Because it is impossible to tell when writing is completed, the
+// returned writer is also a closer. The close operation must be called
+// to write the data that is still buffered. If the last sector is
+// partial, it is padded with zeros and written. If the given writer
+// has a Truncate(int64) error method, like *os.File, it's then called
+// to remove the padding. If it is also an io.Seeker, its offset when
+// writing started is taken into account. Otherwise the padding is left
+// in place. The given writer isn't closed. Calling Close() again
+// returns the same result and Write() after Close() returns ErrClosed.
+// If the given writer is nil or the size is less than 1, nil is
+// returned.
+func NewAlignedWriter(size int, w io.Writer) io.WriteCloser {
+	if w == nil || size < 1 {
+		return nil
+	}
+	return &aligned{w: w, sector: size}
+}
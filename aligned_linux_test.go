@@ -0,0 +1,46 @@
+// Copyright 2014 Joshua Marsh. All rights reserved. Use of this
+// source code is governed by the MIT license that can be found in the
+// LICENSE file.
+
+package wrapio
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestAlignedDirectIO(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "direct")
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR|syscall.O_DIRECT, 0600)
+	if err != nil {
+		t.Skipf("O_DIRECT isn't supported here: %v", err)
+	}
+	defer f.Close()
+	data := bytes.Repeat([]byte("0123456789"), 100001)
+	w := NewAlignedWriter(4096, f)
+	if _, err := io.Copy(w, bytes.NewReader(data)); err != nil {
+		t.Fatalf("io.Copy returned %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close returned %v", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatalf("stat returned %v", err)
+	}
+	if fi.Size() != int64(len(data)) {
+		t.Fatalf("file is %v bytes, expected %v", fi.Size(), len(data))
+	}
+	f.Seek(0, io.SeekStart)
+	got := &bytes.Buffer{}
+	if _, err := io.Copy(got, NewAlignedReader(4096, f)); err != nil {
+		t.Fatalf("reading returned %v", err)
+	}
+	if !bytes.Equal(got.Bytes(), data) {
+		t.Errorf("read back %v bytes, expected %v", got.Len(), len(data))
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2014 Joshua Marsh. All rights reserved. Use of this
+// source code is governed by the MIT license that can be found in the
+// LICENSE file.
+
+package wrapio
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+	"unsafe"
+)
+
+// alignWriter checks that every write is whole sectors from page
+// aligned memory.
+type alignWriter struct {
+	t      *testing.T
+	sector int
+	buf    bytes.Buffer
+}
+
+func (a *alignWriter) Write(p []byte) (int, error) {
+	if len(p)%a.sector != 0 {
+		a.t.Errorf("write of %v bytes isn't whole sectors", len(p))
+	}
+	if uintptr(unsafe.Pointer(&p[0]))%uintptr(os.Getpagesize()) != 0 {
+		a.t.Errorf("write isn't page aligned")
+	}
+	return a.buf.Write(p)
+}
+
+func TestAlignedBuffer(t *testing.T) {
+	for _, n := range []int{0, 1, 512, 4096, 100000} {
+		b := AlignedBuffer(n)
+		if len(b) != n || cap(b) != n {
+			t.Errorf("AlignedBuffer(%v) has len %v and cap %v", n, len(b), cap(b))
+		}
+		if n > 0 && uintptr(unsafe.Pointer(&b[0]))%uintptr(os.Getpagesize()) != 0 {
+			t.Errorf("AlignedBuffer(%v) isn't page aligned", n)
+		}
+	}
+}
+
+func TestAlignedWriter(t *testing.T) {
+	for _, l := range []int{0, 1, 511, 512, 513, alignedBufferSize + 7} {
+		data := make([]byte, l)
+		for x := range data {
+			data[x] = byte(x % 251)
+		}
+		// Into a plain writer, the padding stays.
+		aw := &alignWriter{t: t, sector: 512}
+		w := NewAlignedWriter(512, aw)
+		for x := 0; x < len(data); x += 1000 {
+			end := x + 1000
+			if end > len(data) {
+				end = len(data)
+			}
+			if n, err := w.Write(data[x:end]); n != end-x || err != nil {
+				t.Errorf("len %v: write returned %v %v", l, n, err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Errorf("len %v: close returned %v", l, err)
+		}
+		expected := append(data, make([]byte, (512-l%512)%512)...)
+		if !bytes.Equal(aw.buf.Bytes(), expected) {
+			t.Errorf("len %v: wrote %v bytes, expected %v", l, aw.buf.Len(), len(expected))
+		}
+		// Into a file, the padding is truncated, even when we don't
+		// start at the beginning.
+		f, err := os.Create(filepath.Join(t.TempDir(), "aligned"))
+		if err != nil {
+			t.Fatalf("creating file: %v", err)
+		}
+		f.Write(make([]byte, 1024))
+		w = NewAlignedWriter(512, f)
+		io.Copy(w, bytes.NewReader(data))
+		if err := w.Close(); err != nil {
+			t.Errorf("len %v: file close returned %v", l, err)
+		}
+		f.Seek(1024, io.SeekStart)
+		got, err := ioutil.ReadAll(NewAlignedReader(512, iotest.HalfReader(f)))
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("len %v: read back %v bytes, %v", l, len(got), err)
+		}
+		f.Close()
+	}
+	// Test the special cases.
+	if NewAlignedWriter(512, nil) != nil {
+		t.Errorf("nil io.Writer didn't return nil.")
+	}
+	if NewAlignedWriter(0, ioutil.Discard) != nil {
+		t.Errorf("zero size didn't return nil.")
+	}
+	if NewAlignedReader(512, nil) != nil {
+		t.Errorf("nil io.Reader didn't return nil.")
+	}
+	if NewAlignedReader(0, &bytes.Buffer{}) != nil {
+		t.Errorf("zero size didn't return nil.")
+	}
+	e := fmt.Errorf("i did it")
+	w := NewAlignedWriter(512, ew{err: e})
+	if n, err := w.Write(make([]byte, alignedBufferSize+1)); n != 0 || err != e {
+		t.Errorf("bad error writer results: %v %v", n, err)
+	}
+	if err := w.Close(); err != e {
+		t.Errorf("bad error close results: %v", err)
+	}
+	if _, err := w.Write([]byte("x")); err != ErrClosed {
+		t.Errorf("Write() after Close() returned %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2014 Joshua Marsh. All rights reserved. Use of this
+// source code is governed by the MIT license that can be found in the
+// LICENSE file.
+
+package wrapio
+
+import (
+	"crypto/cipher"
+	"io"
+)
+
+// cryptBlocks returns a handler that runs whole blocks through the
+// given block mode in place. Anything else is an error because
+// CryptBlocks would panic.
+func cryptBlocks(bm cipher.BlockMode) func([]byte) error {
+	bs := bm.BlockSize()
+	return func(p []byte) error {
+		if len(p)%bs != 0 {
+			return ErrPartialBlock
+		}
+		bm.CryptBlocks(p, p)
+		return nil
+	}
+}
+
+// BlockModeReader implements the io.Reader interface.
+type blockModeReader struct {
+	r    io.Reader // The last func reader at the top of the chain.
+	pad  Padding
+	bs   int
+	buf  []byte
+	off  int
+	end  int
+	err  error
+	seen bool // Set once the padding handler is called.
+}
+
+// Read implements the io.Reader interface.
+func (b *blockModeReader) Read(p []byte) (int, error) {
+	if b.off == b.end {
+		if b.err != nil {
+			return 0, b.err
+		}
+		// We read into our own buffer, which is a multiple of the
+		// block size, so each chunk is a whole number of blocks no
+		// matter what size p is.
+		n, err := b.r.Read(b.buf)
+		b.off, b.end = 0, n
+		if err == io.EOF && !b.seen {
+			// There was no data at all. Let the padding decide if that
+			// is valid.
+			if _, perr := b.pad.Unpad(nil, b.bs); perr != nil {
+				err = perr
+			}
+		}
+		b.err = err
+	}
+	n := copy(p, b.buf[b.off:b.end])
+	b.off += n
+	if b.off == b.end && b.err != nil {
+		return n, b.err
+	}
+	return n, nil
+}
+
+func (b *blockModeReader) unpad(p []byte) ([]byte, error) {
+	b.seen = true
+	return b.pad.Unpad(p, b.bs)
+}
+
+// NewBlockModeReader returns an io.Reader that decrypts the data read
+// from the given io.Reader with the given cipher.BlockMode, which
+// should be a decrypter, and removes the padding from the end. It is
+// built from NewBlockReader, NewFuncReaderE and NewLastFuncReaderE.
+//
+// If the data isn't a multiple of the block size, ErrPartialBlock is
+// returned. If the padding is invalid, a *PaddingError is returned in
+// place of io.EOF. Everything but the last chunk of data is returned
+// before the padding can be checked, so nothing should be trusted
+// until io.EOF is reached. If any of the parameters are nil, nil is
+// returned.
+func NewBlockModeReader(bm cipher.BlockMode, pad Padding,
+	r io.Reader) io.Reader {
+	if bm == nil || pad == nil || r == nil {
+		return nil
+	}
+	bs := bm.BlockSize()
+	size := (defaultBufSize / bs) * bs
+	if size == 0 {
+		size = bs
+	}
+	b := &blockModeReader{pad: pad, bs: bs, buf: make([]byte, size)}
+	block := NewBlockReader(bs, r)
+	crypt := NewFuncReaderE(cryptBlocks(bm), block)
+	b.r = NewLastFuncReaderE(b.unpad, crypt)
+	return b
+}
+
+// BlockModeWriter implements the io.Writer interface. It gets whole
+// blocks from the block writer above it.
+type blockModeWriter struct {
+	bm  cipher.BlockMode
+	w   io.Writer
+	buf []byte
+}
+
+// Write implements the io.Writer interface. The block writer passes
+// our caller's data straight through, so we encrypt a copy of it.
+func (b *blockModeWriter) Write(p []byte) (int, error) {
+	if len(p)%b.bm.BlockSize() != 0 {
+		return 0, ErrPartialBlock
+	}
+	for x := 0; x < len(p); {
+		n := copy(b.buf, p[x:])
+		b.bm.CryptBlocks(b.buf[:n], b.buf[:n])
+		if _, err := b.w.Write(b.buf[:n]); err != nil {
+			return x, err
+		}
+		x += n
+	}
+	return len(p), nil
+}
+
+// NewBlockModeWriter returns an io.Writer that pads and encrypts the
+// data written to it with the given cipher.BlockMode, which should be
+// an encrypter, before sending it to the given io.Writer. It is built
+// from NewBlockWriter with the BlockPadTail and BlockPassThrough
+// options, since it encrypts into its own buffer.
+//
+// Because it is impossible to tell when writing is completed, the
+// returned writer is also a closer. The close operation must be called
+// to pad and write the last block. It does not close the given
+// io.Writer. If any of the parameters are nil, nil is returned.
+func NewBlockModeWriter(bm cipher.BlockMode, pad Padding,
+	w io.Writer) io.WriteCloser {
+	if bm == nil || pad == nil || w == nil {
+		return nil
+	}
+	bs := bm.BlockSize()
+	l := (blockCopySize / bs) * bs
+	if l == 0 {
+		l = bs
+	}
+	b := &blockModeWriter{bm: bm, w: w, buf: make([]byte, l)}
+	return NewBlockWriter(bs, b, BlockPadTail(pad), BlockPassThrough())
+}
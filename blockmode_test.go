@@ -0,0 +1,150 @@
+// Copyright 2014 Joshua Marsh. All rights reserved. Use of this
+// source code is governed by the MIT license that can be found in the
+// LICENSE file.
+
+package wrapio
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func ExampleNewBlockModeWriter() {
+	key := make([]byte, 32)
+	iv := make([]byte, aes.BlockSize)
+	b, _ := aes.NewCipher(key)
+	// Encrypt by writing.
+	ct := &bytes.Buffer{}
+	w := NewBlockModeWriter(cipher.NewCBCEncrypter(b, iv), PKCS7Padding, ct)
+	io.WriteString(w, "See what I did there?")
+	w.Close()
+	fmt.Println(ct.Len())
+	// Decrypt by reading.
+	r := NewBlockModeReader(cipher.NewCBCDecrypter(b, iv), PKCS7Padding, ct)
+	pt, err := ioutil.ReadAll(r)
+	fmt.Println(string(pt), err)
+	// Output:
+	// 32
+	// See what I did there? <nil>
+}
+
+// cbc returns the plain CBC encryption of PKCS#7 padded data.
+func cbc(b cipher.Block, iv, data []byte) []byte {
+	p := PKCS7Padding.Pad(append([]byte(nil), data...), b.BlockSize())
+	cipher.NewCBCEncrypter(b, iv).CryptBlocks(p, p)
+	return p
+}
+
+func TestBlockMode(t *testing.T) {
+	key := make([]byte, 16)
+	iv := []byte("0123456789abcdef")
+	b, _ := aes.NewCipher(key)
+	for _, l := range []int{0, 1, 15, 16, 17, 31, 32, 100, 5000} {
+		data := []byte(strings.Repeat("x", l))
+		expected := cbc(b, iv, data)
+		for _, chunk := range []int{1, 7, 16, 4096, 10000} {
+			// Write it in chunks.
+			ct := &bytes.Buffer{}
+			w := NewBlockModeWriter(cipher.NewCBCEncrypter(b, iv), PKCS7Padding, ct)
+			for x := 0; x < len(data); x += chunk {
+				end := x + chunk
+				if end > len(data) {
+					end = len(data)
+				}
+				if n, err := w.Write(data[x:end]); n != end-x || err != nil {
+					t.Errorf("len %v, chunk %v: write returned %v %v", l, chunk, n, err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Errorf("len %v, chunk %v: close returned %v", l, chunk, err)
+			}
+			if !bytes.Equal(ct.Bytes(), expected) {
+				t.Errorf("len %v, chunk %v: cipher text differs", l, chunk)
+			}
+			if string(data) != strings.Repeat("x", l) {
+				t.Fatalf("len %v, chunk %v: written data was changed", l, chunk)
+			}
+			// Read it back in chunks.
+			r := NewBlockModeReader(cipher.NewCBCDecrypter(b, iv), PKCS7Padding,
+				iotest.HalfReader(bytes.NewReader(expected)))
+			pt := &bytes.Buffer{}
+			p := make([]byte, chunk)
+			var err error
+			for err == nil {
+				var n int
+				n, err = r.Read(p)
+				pt.Write(p[:n])
+			}
+			if err != io.EOF || !bytes.Equal(pt.Bytes(), data) {
+				t.Errorf("len %v, chunk %v: read %v bytes, %v", l, chunk, pt.Len(), err)
+			}
+		}
+	}
+}
+
+func TestBlockModeReaderErrors(t *testing.T) {
+	key := make([]byte, 16)
+	iv := make([]byte, 16)
+	b, _ := aes.NewCipher(key)
+	good := cbc(b, iv, []byte("this is a test."))
+	// Bad padding.
+	bad := cbc(b, iv, []byte("0123456789abcdef"))
+	bad = bad[:16]
+	tests := []struct {
+		ct  []byte
+		err func(error) bool
+	}{
+		{
+			ct:  good[:len(good)-1],
+			err: func(err error) bool { return err == ErrPartialBlock },
+		},
+		{
+			ct: bad,
+			err: func(err error) bool {
+				_, ok := err.(*PaddingError)
+				return ok
+			},
+		},
+		{
+			ct: []byte{},
+			err: func(err error) bool {
+				_, ok := err.(*PaddingError)
+				return ok
+			},
+		},
+	}
+	for k, test := range tests {
+		r := NewBlockModeReader(cipher.NewCBCDecrypter(b, iv), PKCS7Padding,
+			bytes.NewReader(test.ct))
+		_, err := ioutil.ReadAll(r)
+		if !test.err(err) {
+			t.Errorf("Test %v: unexpected error: %v", k, err)
+		}
+	}
+	// Test the special error cases.
+	if NewBlockModeReader(nil, PKCS7Padding, bytes.NewReader(good)) != nil {
+		t.Errorf("nil block mode didn't return nil.")
+	}
+	if NewBlockModeReader(cipher.NewCBCDecrypter(b, iv), nil, bytes.NewReader(good)) != nil {
+		t.Errorf("nil padding didn't return nil.")
+	}
+	if NewBlockModeReader(cipher.NewCBCDecrypter(b, iv), PKCS7Padding, nil) != nil {
+		t.Errorf("nil io.Reader didn't return nil.")
+	}
+	if NewBlockModeWriter(nil, PKCS7Padding, ioutil.Discard) != nil {
+		t.Errorf("nil block mode didn't return nil.")
+	}
+	if NewBlockModeWriter(cipher.NewCBCEncrypter(b, iv), nil, ioutil.Discard) != nil {
+		t.Errorf("nil padding didn't return nil.")
+	}
+	if NewBlockModeWriter(cipher.NewCBCEncrypter(b, iv), PKCS7Padding, nil) != nil {
+		t.Errorf("nil io.Writer didn't return nil.")
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2014 Joshua Marsh. All rights reserved. Use of this
+// source code is governed by the MIT license that can be found in the
+// LICENSE file.
+
+package wrapio
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// aLongTimeAgo is a deadline that has already passed. Setting it
+// interrupts any call that is blocked.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// CtxIO implements the io.Closer, io.Reader, and io.Writer interface.
+type ctxIO struct {
+	ctx         context.Context
+	r           io.Reader
+	w           io.Writer
+	setDeadline func(time.Time) error // Nil if deadlines aren't supported.
+	stop        chan struct{}         // Closed by Close() to release the watcher.
+	done        chan struct{}         // Closed when the watcher exits.
+	interrupted bool                  // Set by the watcher before it exits.
+	closed      atomic.Bool
+	once        sync.Once
+}
+
+// watch interrupts blocked calls by setting a deadline in the past
+// once the context is done. It exits when that happens or when Close()
+// is called.
+func (c *ctxIO) watch() {
+	if c.setDeadline == nil || c.ctx.Done() == nil {
+		return
+	}
+	c.stop = make(chan struct{})
+	c.done = make(chan struct{})
+	go func() {
+		defer close(c.done)
+		select {
+		case <-c.ctx.Done():
+			c.interrupted = true
+			c.setDeadline(aLongTimeAgo)
+		case <-c.stop:
+		}
+	}()
+}
+
+// fix replaces the error from an interrupted call with the context's.
+func (c *ctxIO) fix(err error) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		if cerr := c.ctx.Err(); cerr != nil {
+			return cerr
+		}
+	}
+	return err
+}
+
+// Read implements the io.Reader interface.
+func (c *ctxIO) Read(p []byte) (int, error) {
+	if c.closed.Load() {
+		return 0, ErrClosed
+	}
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := c.r.Read(p)
+	return n, c.fix(err)
+}
+
+// Write implements the io.Writer interface.
+func (c *ctxIO) Write(p []byte) (int, error) {
+	if c.closed.Load() {
+		return 0, ErrClosed
+	}
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := c.w.Write(p)
+	return n, c.fix(err)
+}
+
+// Close implements the io.Closer interface. It releases the watcher
+// and clears the deadline if the watcher set one.
+func (c *ctxIO) Close() error {
+	c.closed.Store(true)
+	var err error
+	c.once.Do(func() {
+		if c.stop == nil {
+			return
+		}
+		close(c.stop)
+		<-c.done
+		if c.interrupted {
+			err = c.setDeadline(time.Time{})
+		}
+	})
+	return err
+}
+
+// WithContext returns an io.Reader that stops reading from the given
+// io.Reader once the context is done. Every Read() after that returns
+// ctx.Err(). If the reader has a SetReadDeadline method, like net.Conn
+// and *os.File, a Read() that is blocked when the context is done is
+// interrupted by setting a deadline in the past and also returns
+// ctx.Err(). Otherwise it finishes on its own.
+//
+// Put it closest to the underlying reader and the other wrappers in
+// this package on top of it. They pass its errors along. Wrappers
+// don't have deadlines, so a blocked Read() below the returned reader
+// can't be interrupted.
+//
+// The returned reader is also a closer. Closing it releases the
+// goroutine that watches the context, clears the deadline if one was
+// set and makes Read() return ErrClosed. It does not close the given
+// io.Reader. If either of the parameters are nil, nil is returned.
+func WithContext(ctx context.Context, r io.Reader) io.ReadCloser {
+	if ctx == nil || r == nil {
+		return nil
+	}
+	c := &ctxIO{ctx: ctx, r: r}
+	if d, ok := r.(interface{ SetReadDeadline(time.Time) error }); ok {
+		c.setDeadline = d.SetReadDeadline
+	}
+	c.watch()
+	return c
+}
+
+// WithContextWriter is the io.Writer version of WithContext. It uses
+// SetWriteDeadline to interrupt a blocked Write(), in which case some
+// of the data may have been written. It does not close the given
+// io.Writer. If either of the parameters are nil, nil is returned.
+func WithContextWriter(ctx context.Context, w io.Writer) io.WriteCloser {
+	if ctx == nil || w == nil {
+		return nil
+	}
+	c := &ctxIO{ctx: ctx, w: w}
+	if d, ok := w.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		c.setDeadline = d.SetWriteDeadline
+	}
+	c.watch()
+	return c
+}
@@ -0,0 +1,193 @@
+// Copyright 2014 Joshua Marsh. All rights reserved. Use of this
+// source code is governed by the MIT license that can be found in the
+// LICENSE file.
+
+package wrapio
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// afterCancel runs f and cancels the context once f has had time to
+// block. It fails if f doesn't return soon after.
+func afterCancel(t *testing.T, cancel func(), f func() error) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- f()
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-errc:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatalf("call wasn't interrupted")
+	}
+	return nil
+}
+
+func TestWithContext(t *testing.T) {
+	// Without deadlines, we can only stop between calls.
+	ctx, cancel := context.WithCancel(context.Background())
+	r := WithContext(ctx, strings.NewReader("0123456789"))
+	p := make([]byte, 5)
+	if n, err := r.Read(p); n != 5 || err != nil {
+		t.Errorf("first read returned %v %v", n, err)
+	}
+	if r.(*ctxIO).stop != nil {
+		t.Errorf("watcher started without deadline support")
+	}
+	cancel()
+	if n, err := r.Read(p); n != 0 || err != context.Canceled {
+		t.Errorf("read after cancel returned %v %v", n, err)
+	}
+	r.Close()
+	if _, err := r.Read(p); err != ErrClosed {
+		t.Errorf("read after close returned %v", err)
+	}
+	// With deadlines, a blocked call is interrupted.
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	ctx, cancel = context.WithCancel(context.Background())
+	r = WithContext(ctx, a)
+	err := afterCancel(t, cancel, func() error {
+		_, err := r.Read(p)
+		return err
+	})
+	if err != context.Canceled {
+		t.Errorf("interrupted read returned %v", err)
+	}
+	// Closing clears the deadline so the connection can be used again.
+	r.Close()
+	go b.Write([]byte("ok"))
+	if n, err := a.Read(p); n != 2 || err != nil {
+		t.Errorf("read after close returned %v %v", n, err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	w := WithContextWriter(ctx, a)
+	err = afterCancel(t, cancel, func() error {
+		_, err := w.Write(p)
+		return err
+	})
+	if err != context.Canceled {
+		t.Errorf("interrupted write returned %v", err)
+	}
+	w.Close()
+	if _, err := w.Write(p); err != ErrClosed {
+		t.Errorf("write after close returned %v", err)
+	}
+	// Test the special cases.
+	if WithContext(context.Background(), nil) != nil {
+		t.Errorf("nil io.Reader didn't return nil.")
+	}
+	if WithContextWriter(context.Background(), nil) != nil {
+		t.Errorf("nil io.Writer didn't return nil.")
+	}
+}
+
+func TestWithContextClose(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := WithContext(ctx, a)
+	c := r.(*ctxIO)
+	if c.stop == nil {
+		t.Fatalf("watcher wasn't started")
+	}
+	for x := 0; x < 2; x++ {
+		if err := r.Close(); err != nil {
+			t.Errorf("Close() returned %v", err)
+		}
+	}
+	select {
+	case <-c.done:
+	default:
+		t.Errorf("watcher is still running after Close()")
+	}
+}
+
+func TestWithContextCompose(t *testing.T) {
+	readers := map[string]func(io.Reader) io.Reader{
+		"func": func(r io.Reader) io.Reader {
+			return NewFuncReader(func([]byte) {}, r)
+		},
+		"hash": func(r io.Reader) io.Reader {
+			return NewHashReader(md5.New(), r)
+		},
+		"stats": func(r io.Reader) io.Reader {
+			_, sr := NewStatsReader(r)
+			return sr
+		},
+		"block": func(r io.Reader) io.Reader {
+			return NewBlockReader(4, r)
+		},
+		"last": func(r io.Reader) io.Reader {
+			return NewLastFuncReader(func(p []byte) []byte { return p }, r)
+		},
+	}
+	for name, wrap := range readers {
+		a, b := net.Pipe()
+		ctx, cancel := context.WithCancel(context.Background())
+		cr := WithContext(ctx, a)
+		r := wrap(cr)
+		err := afterCancel(t, cancel, func() error {
+			_, err := ioutil.ReadAll(r)
+			return err
+		})
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("%v reader returned %v", name, err)
+		}
+		cr.Close()
+		a.Close()
+		b.Close()
+	}
+	writers := map[string]func(io.Writer) io.Writer{
+		"func": func(w io.Writer) io.Writer {
+			return NewFuncWriter(func([]byte) {}, w)
+		},
+		"hash": func(w io.Writer) io.Writer {
+			return NewHashWriter(md5.New(), w)
+		},
+		"stats": func(w io.Writer) io.Writer {
+			_, sw := NewStatsWriter(w)
+			return sw
+		},
+		"block": func(w io.Writer) io.Writer {
+			return NewBlockWriter(4, w)
+		},
+		"last": func(w io.Writer) io.Writer {
+			return NewLastFuncWriter(func(p []byte) []byte { return p }, w)
+		},
+	}
+	for name, wrap := range writers {
+		a, b := net.Pipe()
+		ctx, cancel := context.WithCancel(context.Background())
+		cw := WithContextWriter(ctx, a)
+		w := wrap(cw)
+		err := afterCancel(t, cancel, func() error {
+			// The last func writer holds on to the first write.
+			for {
+				if _, err := w.Write([]byte("0123")); err != nil {
+					return err
+				}
+			}
+		})
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("%v writer returned %v", name, err)
+		}
+		cw.Close()
+		a.Close()
+		b.Close()
+	}
+}
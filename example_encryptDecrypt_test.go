@@ -55,7 +55,8 @@ func Example_encryptDecrypt() {
 		// block size (it will panic otherwise).
 		block = wrapio.NewBlockReader(bme.BlockSize(), in)
 		// The last block may not have a full block, so we should pad it.
-		last = wrapio.NewLastFuncReader(pad, block)
+		last = wrapio.NewLastFuncReader(
+			wrapio.PadFunc(wrapio.ISO7816Padding, bme.BlockSize()), block)
 		// Finally, we encrypt the data.
 		crypt = wrapio.NewFuncReader(func(p []byte) {
 			bme.CryptBlocks(p, p)
@@ -81,8 +82,10 @@ func Example_encryptDecrypt() {
 		crypt = wrapio.NewFuncReader(func(p []byte) {
 			bmd.CryptBlocks(p, p)
 		}, block)
-		// The last block may have padding at the end, so remove it.
-		last = wrapio.NewLastFuncReader(unpad, crypt)
+		// The last block may have padding at the end, so remove it. If
+		// the padding is bad, we'll get an error instead of io.EOF.
+		last = wrapio.NewLastFuncReaderE(
+			wrapio.UnpadFunc(wrapio.ISO7816Padding, bmd.BlockSize()), crypt)
 		// We'll use ReadAll to get the plain text. If we wanted to save
 		// it to a file, we could use io.Copy.
 		pt, err := ioutil.ReadAll(last)
@@ -93,27 +96,3 @@ func Example_encryptDecrypt() {
 		fmt.Println()
 	}
 }
-
-func unpad(p []byte) []byte {
-	l := len(p)
-	nl := l - 1
-	for ; nl >= 0; nl-- {
-		if p[nl] == 0x80 {
-			break
-		}
-		if p[nl] != 0x00 || (l-nl) > aes.BlockSize {
-			return p
-		}
-	}
-	return p[:nl]
-}
-
-func pad(m []byte) []byte {
-	l := len(m)
-	pl := aes.BlockSize - l%aes.BlockSize
-	m = append(m, 0x80)
-	for x := 0; x < pl-1; x++ {
-		m = append(m, 0x00)
-	}
-	return m
-}
@@ -0,0 +1,86 @@
+// Copyright 2014 Joshua Marsh. All rights reserved. Use of this
+// source code is governed by the MIT license that can be found in the
+// LICENSE file.
+
+package wrapio
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+var (
+	publishedMu sync.Mutex
+	published   = map[string]*Stats{}
+)
+
+// PublishStats exposes the given Stats through the expvar package
+// under the given name, so its live values show up as JSON at
+// /debug/vars. It is safe to call repeatedly with the same name; the
+// latest Stats replaces the earlier one. A nil Stats is the same as
+// calling UnpublishStats, so it does nothing for a name that hasn't
+// been published.
+//
+// Like expvar.Publish, it panics if the name is already used by a
+// variable that wasn't published by PublishStats.
+func PublishStats(name string, s *Stats) {
+	publishedMu.Lock()
+	defer publishedMu.Unlock()
+	if _, ok := published[name]; !ok {
+		if s == nil {
+			return
+		}
+		// The expvar package has no way to remove a variable, so we
+		// only publish each name once and look up the Stats each time
+		// it is rendered.
+		expvar.Publish(name, expvar.Func(func() interface{} {
+			return statsVar(name)
+		}))
+	}
+	published[name] = s
+}
+
+// UnpublishStats stops exposing the Stats published under the given
+// name. Because expvar can't remove a variable, the name stays in
+// /debug/vars and renders as null until it is published again, and
+// nothing else can be published under it.
+func UnpublishStats(name string) {
+	publishedMu.Lock()
+	defer publishedMu.Unlock()
+	if _, ok := published[name]; ok {
+		published[name] = nil
+	}
+}
+
+// statsVar returns the value rendered for the published name.
+func statsVar(name string) interface{} {
+	publishedMu.Lock()
+	s := published[name]
+	publishedMu.Unlock()
+	if s == nil {
+		return nil
+	}
+	snap := s.Snapshot()
+	return map[string]interface{}{
+		"total":       snap.Total,
+		"average":     snap.Average,
+		"calls":       snap.Calls,
+		"zero_calls":  snap.ZeroCalls,
+		"error_calls": snap.ErrorCalls,
+		"in_flight":   snap.InFlight,
+		"start":       snap.Start.Format(time.RFC3339Nano),
+		"last":        snap.Last.Format(time.RFC3339Nano),
+		"throughput":  snap.Throughput(),
+		"rate_1s":     snap.MovingRate(time.Second),
+		"rate_10s":    snap.MovingRate(10 * time.Second),
+		"rate_60s":    snap.MovingRate(time.Minute),
+		"size_p50":    snap.Sizes.P50(),
+		"size_p90":    snap.Sizes.P90(),
+		"size_p99":    snap.Sizes.P99(),
+		"latency_p50": time.Duration(snap.Latencies.P50()).Seconds(),
+		"latency_p90": time.Duration(snap.Latencies.P90()).Seconds(),
+		"latency_p99": time.Duration(snap.Latencies.P99()).Seconds(),
+		"throttled":   snap.Throttled.Seconds(),
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2014 Joshua Marsh. All rights reserved. Use of this
+// source code is governed by the MIT license that can be found in the
+// LICENSE file.
+
+package wrapio
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPublishStats(t *testing.T) {
+	get := func(name string) map[string]interface{} {
+		v := expvar.Get(name)
+		if v == nil {
+			t.Fatalf("%v wasn't published", name)
+		}
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(v.String()), &m); err != nil {
+			t.Fatalf("bad json for %v: %v", name, err)
+		}
+		return m
+	}
+	s, r := NewStatsReader(strings.NewReader("0123456789"))
+	PublishStats("wrapio_test_publish", s)
+	if m := get("wrapio_test_publish"); m["total"] != 0.0 {
+		t.Errorf("total (%v) != expected (%v)", m["total"], 0)
+	}
+	ioutil.ReadAll(r)
+	if m := get("wrapio_test_publish"); m["total"] != 10.0 || m["calls"] != 1.0 {
+		t.Errorf("live values not shown: %v", m)
+	}
+	// Publishing again replaces it rather than panicking.
+	s2, _ := NewStatsWriter(ioutil.Discard)
+	PublishStats("wrapio_test_publish", s2)
+	if m := get("wrapio_test_publish"); m["total"] != 0.0 {
+		t.Errorf("republished stats not shown: %v", m)
+	}
+	UnpublishStats("wrapio_test_publish")
+	if m := get("wrapio_test_publish"); m != nil {
+		t.Errorf("unpublished stats still shown: %v", m)
+	}
+	UnpublishStats("wrapio_test_never_published")
+	if expvar.Get("wrapio_test_never_published") != nil {
+		t.Errorf("unpublishing an unknown name published it")
+	}
+	// A nil Stats doesn't take a new name. Since expvar never forgets
+	// one, each run needs its own.
+	name := fmt.Sprintf("wrapio_test_nil_%d", time.Now().UnixNano())
+	PublishStats(name, nil)
+	if expvar.Get(name) != nil {
+		t.Errorf("nil stats were published")
+	}
+	PublishStats(name, s)
+	if m := get(name); m["total"] != 10.0 {
+		t.Errorf("stats published after nil not shown: %v", m)
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2014 Joshua Marsh. All rights reserved. Use of this
+// source code is governed by the MIT license that can be found in the
+// LICENSE file.
+
+package wrapio
+
+import (
+	"io"
+)
+
+// framedReadSize is the least we ask the underlying reader for at a
+// time.
+const framedReadSize = 4096
+
+// Framed implements the io.Reader interface.
+type framed struct {
+	r          io.Reader
+	headerLen  int
+	trailerLen int
+	onHeader   func([]byte) error
+	onTrailer  func([]byte) error
+	started    bool
+	buf        []byte // The data we've read but not returned.
+	off        int    // Where the unreturned data starts in buf.
+	rerr       error  // The error from the underlying reader.
+	err        error  // What we return once buf is drained.
+}
+
+// header reads the header and hands it off.
+func (f *framed) header() error {
+	h := make([]byte, f.headerLen)
+	if _, err := io.ReadFull(f.r, h); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if f.onHeader != nil {
+		return f.onHeader(h)
+	}
+	return nil
+}
+
+// fill reads more data into buf, making room for at least n bytes.
+func (f *framed) fill(n int) {
+	// Move the held bytes to the front. There are at most trailerLen
+	// of them.
+	l := copy(f.buf, f.buf[f.off:])
+	f.buf, f.off = f.buf[:l], 0
+	if n < framedReadSize {
+		n = framedReadSize
+	}
+	if cap(f.buf)-l < n {
+		nb := make([]byte, l, l+n)
+		copy(nb, f.buf)
+		f.buf = nb
+	}
+	m, err := f.r.Read(f.buf[l:cap(f.buf)])
+	f.buf = f.buf[:l+m]
+	f.rerr = err
+}
+
+// Read implements the io.Reader interface.
+func (f *framed) Read(p []byte) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	if !f.started {
+		f.started = true
+		if f.err = f.header(); f.err != nil {
+			return 0, f.err
+		}
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for {
+		// Everything but the last trailerLen bytes can go out.
+		if avail := len(f.buf) - f.off - f.trailerLen; avail > 0 {
+			if avail > len(p) {
+				avail = len(p)
+			}
+			n := copy(p, f.buf[f.off:f.off+avail])
+			f.off += n
+			return n, nil
+		}
+		if f.rerr != nil {
+			break
+		}
+		before := len(f.buf) - f.off
+		f.fill(len(p))
+		if len(f.buf) == before && f.rerr == nil {
+			// The reader gave us nothing. We'll try again next time.
+			return 0, nil
+		}
+	}
+	// We have the trailer or the stream ended early.
+	f.err = f.rerr
+	if f.err == io.EOF {
+		if trailer := f.buf[f.off:]; len(trailer) < f.trailerLen {
+			f.err = io.ErrUnexpectedEOF
+		} else if f.onTrailer != nil {
+			if err := f.onTrailer(trailer); err != nil {
+				f.err = err
+			}
+		}
+	}
+	return 0, f.err
+}
+
+// NewFramedReader returns an io.Reader that strips a header of
+// headerLen bytes from the start of the given reader and a trailer of
+// trailerLen bytes from the end of it. The header is read and given to
+// onHeader before any data is returned. The trailer is given to
+// onTrailer once the given reader returns io.EOF, after all of the
+// data in between has been returned. Exactly trailerLen bytes are held
+// back no matter what size slices Read() is given.
+//
+// If either handler returns an error, it's returned in place of the
+// data or io.EOF and from every Read() after it. If the stream is too
+// short to hold the header and trailer, io.ErrUnexpectedEOF is
+// returned. Other errors from the given reader are returned once the
+// data before them has been, but the trailer isn't, since it can't be
+// told apart from the data. Either handler can be nil, in which case
+// that part is just dropped. If the reader is nil or either length is
+// negative, nil is returned.
+func NewFramedReader(headerLen, trailerLen int, onHeader func([]byte) error,
+	onTrailer func([]byte) error, r io.Reader) io.Reader {
+	if r == nil || headerLen < 0 || trailerLen < 0 {
+		return nil
+	}
+	return &framed{
+		r:          r,
+		headerLen:  headerLen,
+		trailerLen: trailerLen,
+		onHeader:   onHeader,
+		onTrailer:  onTrailer,
+	}
+}
+
+// TailSplitReader is an io.Reader that returns everything but the
+// last n bytes of the reader it wraps. Those are available from Tail()
+// once the data has all been read. It's useful for streams like
+// "payload || MAC" where the size of the end is known.
+type TailSplitReader struct {
+	r    io.Reader
+	tail []byte
+}
+
+// Read implements the io.Reader interface.
+func (t *TailSplitReader) Read(p []byte) (int, error) {
+	return t.r.Read(p)
+}
+
+// Tail returns the last n bytes of the stream. It returns nil until
+// Read() has returned io.EOF.
+func (t *TailSplitReader) Tail() []byte {
+	return t.tail
+}
+
+// NewTailSplitReader returns a TailSplitReader that holds back the last
+// n bytes of the given reader no matter how the data is chunked. If
+// the stream is shorter than n bytes, io.ErrUnexpectedEOF is returned.
+// If the reader is nil or n is negative, nil is returned.
+func NewTailSplitReader(n int, r io.Reader) *TailSplitReader {
+	if r == nil || n < 0 {
+		return nil
+	}
+	t := &TailSplitReader{}
+	t.r = NewFramedReader(0, n, nil, func(p []byte) error {
+		t.tail = append([]byte{}, p...)
+		return nil
+	}, r)
+	return t
+}
@@ -0,0 +1,176 @@
+// Copyright 2014 Joshua Marsh. All rights reserved. Use of this
+// source code is governed by the MIT license that can be found in the
+// LICENSE file.
+
+package wrapio
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func ExampleNewFramedReader() {
+	r := NewFramedReader(4, 2, func(h []byte) error {
+		if string(h) != "MAGC" {
+			return fmt.Errorf("bad magic: %q", h)
+		}
+		return nil
+	}, func(t []byte) error {
+		fmt.Printf("trailer: %s\n", t)
+		return nil
+	}, strings.NewReader("MAGCThe data in the middle.ok"))
+	b, err := ioutil.ReadAll(r)
+	fmt.Println(string(b), err)
+	// Output:
+	// trailer: ok
+	// The data in the middle. <nil>
+}
+
+// readSizes reads all of r using each of the sizes in turn for p.
+func readSizes(r io.Reader, sizes []int) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	for x := 0; ; x++ {
+		p := make([]byte, sizes[x%len(sizes)])
+		n, err := r.Read(p)
+		buf.Write(p[:n])
+		if err == io.EOF {
+			return buf.Bytes(), nil
+		}
+		if err != nil {
+			return buf.Bytes(), err
+		}
+	}
+}
+
+func TestFramedReader(t *testing.T) {
+	data := make([]byte, 20000)
+	for x := range data {
+		data[x] = byte(x % 253)
+	}
+	for _, l := range []int{0, 1, 31, 4096, 20000} {
+		for _, hl := range []int{0, 4} {
+			for _, tl := range []int{0, 1, 32, 5000} {
+				stream := append(append(bytes.Repeat([]byte("h"), hl), data[:l]...),
+					bytes.Repeat([]byte("t"), tl)...)
+				for k, sizes := range [][]int{{1}, {7, 1, 300}, {4096}, {1, 50000, 3}} {
+					var header, trailer []byte
+					r := NewFramedReader(hl, tl, func(p []byte) error {
+						header = append([]byte(nil), p...)
+						return nil
+					}, func(p []byte) error {
+						trailer = append([]byte(nil), p...)
+						return nil
+					}, iotest.HalfReader(bytes.NewReader(stream)))
+					got, err := readSizes(r, sizes)
+					if err != nil || !bytes.Equal(got, data[:l]) {
+						t.Errorf("Test %v/%v/%v(%v): read %v bytes, %v",
+							l, hl, tl, k, len(got), err)
+					}
+					if string(header) != strings.Repeat("h", hl) ||
+						string(trailer) != strings.Repeat("t", tl) {
+						t.Errorf("Test %v/%v/%v(%v): bad header %q or trailer %q",
+							l, hl, tl, k, header, trailer)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestFramedReaderErrors(t *testing.T) {
+	e := fmt.Errorf("i did it")
+	fail := func([]byte) error { return e }
+	tests := []struct {
+		headerLen  int
+		trailerLen int
+		onHeader   func([]byte) error
+		onTrailer  func([]byte) error
+		r          io.Reader
+		data       string
+		err        error
+	}{
+		// Too short for the header or trailer.
+		{headerLen: 4, r: strings.NewReader("abc"), err: io.ErrUnexpectedEOF},
+		{headerLen: 4, r: strings.NewReader(""), err: io.ErrUnexpectedEOF},
+		{headerLen: 2, trailerLen: 2, r: strings.NewReader("abc"),
+			err: io.ErrUnexpectedEOF},
+		// Handler errors.
+		{headerLen: 2, onHeader: fail, r: strings.NewReader("abcdef"), err: e},
+		{trailerLen: 2, onTrailer: fail, r: strings.NewReader("abcdef"),
+			data: "abcd", err: e},
+		// Reader errors keep the trailer.
+		{trailerLen: 2, onTrailer: fail,
+			r:    io.MultiReader(strings.NewReader("abcdef"), er{err: e}),
+			data: "abcd", err: e},
+		{headerLen: 2, r: er{err: e}, err: e},
+		// Nil handlers just drop it.
+		{headerLen: 1, trailerLen: 1, r: strings.NewReader("abc"), data: "b"},
+	}
+	for k, test := range tests {
+		r := NewFramedReader(test.headerLen, test.trailerLen, test.onHeader,
+			test.onTrailer, test.r)
+		got, err := ioutil.ReadAll(r)
+		if string(got) != test.data || err != test.err {
+			t.Errorf("Test %v: got %q %v, expected %q %v",
+				k, got, err, test.data, test.err)
+		}
+		// Errors stick.
+		if n, err := r.Read(make([]byte, 10)); n != 0 || err != test.err &&
+			!(test.err == nil && err == io.EOF) {
+			t.Errorf("Test %v: second read returned %v %v", k, n, err)
+		}
+	}
+	// Test the special cases.
+	if NewFramedReader(0, 0, nil, nil, nil) != nil {
+		t.Errorf("nil io.Reader didn't return nil.")
+	}
+	if NewFramedReader(-1, 0, nil, nil, &bytes.Buffer{}) != nil {
+		t.Errorf("negative header length didn't return nil.")
+	}
+	if NewFramedReader(0, -1, nil, nil, &bytes.Buffer{}) != nil {
+		t.Errorf("negative trailer length didn't return nil.")
+	}
+}
+
+func TestTailSplitReader(t *testing.T) {
+	data := []byte(strings.Repeat("payload", 1000))
+	mac := []byte(strings.Repeat("m", 32))
+	stream := append(append([]byte(nil), data...), mac...)
+	for k, sizes := range [][]int{{1}, {5, 33, 1}, {4096}, {100000}} {
+		r := NewTailSplitReader(32, iotest.OneByteReader(bytes.NewReader(stream)))
+		if r.Tail() != nil {
+			t.Errorf("Test %v: Tail() wasn't nil before EOF", k)
+		}
+		got, err := readSizes(r, sizes)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("Test %v: read %v bytes, %v", k, len(got), err)
+		}
+		if !bytes.Equal(r.Tail(), mac) {
+			t.Errorf("Test %v: Tail() (%q) != expected (%q)", k, r.Tail(), mac)
+		}
+	}
+	// A zero length tail is empty, not nil, once we're done.
+	r := NewTailSplitReader(0, strings.NewReader("abc"))
+	if got, err := ioutil.ReadAll(r); string(got) != "abc" || err != nil ||
+		r.Tail() == nil || len(r.Tail()) != 0 {
+		t.Errorf("zero tail: %q %v %q", got, err, r.Tail())
+	}
+	// Too short.
+	r = NewTailSplitReader(32, strings.NewReader("abc"))
+	if got, err := ioutil.ReadAll(r); len(got) != 0 || err != io.ErrUnexpectedEOF ||
+		r.Tail() != nil {
+		t.Errorf("short stream: %q %v %q", got, err, r.Tail())
+	}
+	// Test the special cases.
+	if NewTailSplitReader(1, nil) != nil {
+		t.Errorf("nil io.Reader didn't return nil.")
+	}
+	if NewTailSplitReader(-1, &bytes.Buffer{}) != nil {
+		t.Errorf("negative length didn't return nil.")
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright 2014 Joshua Marsh. All rights reserved. Use of this
+// source code is governed by the MIT license that can be found in the
+// LICENSE file.
+
+package wrapio
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"hash"
+	"io"
+	"os"
+)
+
+// HMACWriter implements the io.Closer and io.Writer interface.
+type hmacWriter struct {
+	mac    hash.Hash
+	hw     io.Writer
+	w      io.Writer
+	closed bool
+	err    error // The first error from Write() or Close().
+}
+
+// Write implements the io.Writer interface.
+func (h *hmacWriter) Write(p []byte) (int, error) {
+	if h.closed {
+		return 0, ErrClosed
+	}
+	if h.err != nil {
+		return 0, h.err
+	}
+	n, err := h.hw.Write(p)
+	h.err = err
+	return n, err
+}
+
+// Close implements the io.Closer interface. The MAC isn't written if
+// a Write() failed, since it wouldn't match what was.
+func (h *hmacWriter) Close() error {
+	if h.closed || h.err != nil {
+		h.closed = true
+		return h.err
+	}
+	h.closed = true
+	_, h.err = h.w.Write(h.mac.Sum(nil))
+	return h.err
+}
+
+// NewHMACWriter returns an io.Writer that writes everything to the
+// given writer while computing its HMAC with the given hash function
+// and key. It's built on NewHashWriter.
+//
+// Because it is impossible to tell when writing is completed, the
+// returned writer is also a closer. The close operation must be called
+// to append the MAC. It does not close the given io.Writer. If a
+// Write() fails, the error is returned from every call after it and
+// the MAC is never written. Calling Close() again returns the same
+// result and Write() after Close() returns ErrClosed. If the hash
+// function or writer is nil, nil is returned.
+func NewHMACWriter(h func() hash.Hash, key []byte,
+	w io.Writer) io.WriteCloser {
+	if h == nil || w == nil {
+		return nil
+	}
+	mac := hmac.New(h, key)
+	return &hmacWriter{mac: mac, hw: NewHashWriter(mac, w), w: w}
+}
+
+// HMACReader implements the io.Reader interface.
+type hmacReader struct {
+	mac hash.Hash
+	ts  *TailSplitReader
+	r   io.Reader // The hash reader on top of ts.
+	err error
+}
+
+// Read implements the io.Reader interface.
+func (h *hmacReader) Read(p []byte) (int, error) {
+	if h.err != nil {
+		return 0, h.err
+	}
+	n, err := h.r.Read(p)
+	if err == io.EOF && !hmac.Equal(h.mac.Sum(nil), h.ts.Tail()) {
+		err = ErrAuthFailed
+	}
+	if err != nil {
+		h.err = err
+	}
+	return n, err
+}
+
+// NewHMACReader returns an io.Reader that reads a stream made by
+// NewHMACWriter and checks the MAC at the end of it with the given
+// hash function and key. The MAC isn't returned. It's built on
+// NewTailSplitReader and NewHashReader.
+//
+// Data is returned as soon as it is read, so it shouldn't be trusted
+// until EOF is reached. If the MAC doesn't match, ErrAuthFailed is
+// returned in place of io.EOF. If the stream is too short to hold a
+// MAC, io.ErrUnexpectedEOF is returned. Use NewStrictHMACReader if the
+// data is going to be acted on before the end of the stream. If the
+// hash function or reader is nil, nil is returned.
+func NewHMACReader(h func() hash.Hash, key []byte, r io.Reader) io.Reader {
+	if h == nil || r == nil {
+		return nil
+	}
+	mac := hmac.New(h, key)
+	ts := NewTailSplitReader(mac.Size(), r)
+	return &hmacReader{mac: mac, ts: ts, r: NewHashReader(mac, ts)}
+}
+
+// Spool implements the io.Writer interface. It holds up to limit bytes
+// in memory and the rest in a temporary file.
+type spool struct {
+	mem   bytes.Buffer
+	limit int64
+	f     *os.File
+}
+
+// Write implements the io.Writer interface.
+func (s *spool) Write(p []byte) (int, error) {
+	if s.f == nil {
+		if int64(s.mem.Len()+len(p)) <= s.limit {
+			return s.mem.Write(p)
+		}
+		f, err := os.CreateTemp("", "wrapio-spool-")
+		if err != nil {
+			return 0, err
+		}
+		s.f = f
+	}
+	return s.f.Write(p)
+}
+
+// reader returns a reader for everything that was written.
+func (s *spool) reader() (io.Reader, error) {
+	if s.f == nil {
+		return &s.mem, nil
+	}
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return io.MultiReader(&s.mem, s.f), nil
+}
+
+// remove gets rid of the temporary file if there is one.
+func (s *spool) remove() error {
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	if rerr := os.Remove(s.f.Name()); err == nil {
+		err = rerr
+	}
+	s.f = nil
+	return err
+}
+
+// StrictHMACReader implements the io.Closer and io.Reader interface.
+type strictHMACReader struct {
+	hr     io.Reader // The streaming HMAC reader.
+	s      *spool
+	r      io.Reader // The verified data once it's been spooled.
+	err    error
+	closed bool
+}
+
+// Read implements the io.Reader interface.
+func (h *strictHMACReader) Read(p []byte) (int, error) {
+	if h.closed {
+		return 0, ErrClosed
+	}
+	if h.err != nil {
+		return 0, h.err
+	}
+	if h.r == nil {
+		// Spool it all and only let it out if it checks out.
+		if _, err := io.Copy(h.s, h.hr); err != nil {
+			h.err = err
+			h.s.remove()
+			return 0, err
+		}
+		if h.r, h.err = h.s.reader(); h.err != nil {
+			h.s.remove()
+			return 0, h.err
+		}
+	}
+	n, err := h.r.Read(p)
+	if err != nil {
+		h.err = err
+		if rerr := h.s.remove(); err == io.EOF && rerr != nil {
+			h.err = rerr
+		}
+		return n, h.err
+	}
+	return n, nil
+}
+
+// Close implements the io.Closer interface.
+func (h *strictHMACReader) Close() error {
+	if h.closed {
+		return nil
+	}
+	h.closed = true
+	return h.s.remove()
+}
+
+// NewStrictHMACReader is like NewHMACReader except that no data is
+// returned until the whole stream has been read and the MAC checks
+// out. The first Read() spools the data, holding up to maxMemory bytes
+// in memory and the rest in a temporary file. If the MAC doesn't
+// match, ErrAuthFailed is returned and none of the data is.
+//
+// The returned reader is also a closer. Closing it removes the
+// temporary file if it's still around. It's removed on its own once
+// the data has all been read or an error is returned. It does not
+// close the given io.Reader. If the hash function or reader is nil,
+// nil is returned.
+func NewStrictHMACReader(h func() hash.Hash, key []byte, maxMemory int64,
+	r io.Reader) io.ReadCloser {
+	hr := NewHMACReader(h, key, r)
+	if hr == nil {
+		return nil
+	}
+	return &strictHMACReader{hr: hr, s: &spool{limit: maxMemory}}
+}
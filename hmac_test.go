@@ -0,0 +1,206 @@
+// Copyright 2014 Joshua Marsh. All rights reserved. Use of this
+// source code is governed by the MIT license that can be found in the
+// LICENSE file.
+
+package wrapio
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func ExampleNewHMACWriter() {
+	key := []byte("secret")
+	buf := &bytes.Buffer{}
+	w := NewHMACWriter(sha256.New, key, buf)
+	io.WriteString(w, "Trust me.")
+	w.Close()
+	fmt.Println(buf.Len())
+	r := NewStrictHMACReader(sha256.New, key, 1024, buf)
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	fmt.Println(string(b), err)
+	// Output:
+	// 41
+	// Trust me. <nil>
+}
+
+func TestHMAC(t *testing.T) {
+	key := []byte("key")
+	for _, l := range []int{0, 1, 31, 32, 33, 10000} {
+		data := bytes.Repeat([]byte("d"), l)
+		buf := &bytes.Buffer{}
+		w := NewHMACWriter(sha256.New, key, buf)
+		w.Write(data)
+		for x := 0; x < 2; x++ {
+			if err := w.Close(); err != nil {
+				t.Errorf("len %v: Close() returned %v", l, err)
+			}
+		}
+		if _, err := w.Write(data); err != ErrClosed {
+			t.Errorf("len %v: Write() after Close() returned %v", l, err)
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write(data)
+		expected := append(append([]byte(nil), data...), mac.Sum(nil)...)
+		if !bytes.Equal(buf.Bytes(), expected) {
+			t.Errorf("len %v: wrote %x, expected %x", l, buf.Bytes(), expected)
+		}
+		// Read it back in both modes.
+		got, err := ioutil.ReadAll(NewHMACReader(sha256.New, key,
+			iotest.HalfReader(bytes.NewReader(expected))))
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("len %v: streaming read %v bytes, %v", l, len(got), err)
+		}
+		for _, limit := range []int64{0, 1 << 20} {
+			r := NewStrictHMACReader(sha256.New, key, limit,
+				iotest.HalfReader(bytes.NewReader(expected)))
+			got, err := ioutil.ReadAll(r)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("len %v, max %v: strict read %v bytes, %v",
+					l, limit, len(got), err)
+			}
+			if err := r.Close(); err != nil {
+				t.Errorf("len %v, max %v: Close() returned %v", l, limit, err)
+			}
+			if _, err := r.Read(make([]byte, 1)); err != ErrClosed {
+				t.Errorf("len %v, max %v: Read() after Close() returned %v",
+					l, limit, err)
+			}
+		}
+	}
+}
+
+func TestHMACReaderErrors(t *testing.T) {
+	key := []byte("key")
+	data := []byte(strings.Repeat("data", 1000))
+	buf := &bytes.Buffer{}
+	w := NewHMACWriter(sha256.New, key, buf)
+	w.Write(data)
+	w.Close()
+	good := buf.Bytes()
+	flip := func(i int) []byte {
+		b := append([]byte(nil), good...)
+		b[i] ^= 1
+		return b
+	}
+	tests := []struct {
+		stream []byte
+		key    []byte
+		err    error
+	}{
+		{stream: flip(0), key: key, err: ErrAuthFailed},
+		{stream: flip(len(good) - 1), key: key, err: ErrAuthFailed},
+		{stream: good[:len(good)-1], key: key, err: ErrAuthFailed},
+		{stream: good, key: []byte("yek"), err: ErrAuthFailed},
+		{stream: good[:31], key: key, err: io.ErrUnexpectedEOF},
+	}
+	for k, test := range tests {
+		// Streaming gives us the data before the error.
+		got, err := ioutil.ReadAll(NewHMACReader(sha256.New, test.key,
+			bytes.NewReader(test.stream)))
+		expected := len(test.stream) - 32
+		if expected < 0 {
+			expected = 0
+		}
+		if err != test.err || len(got) != expected {
+			t.Errorf("Test %v: streaming read %v bytes, %v", k, len(got), err)
+		}
+		// Strict doesn't.
+		for _, limit := range []int64{0, 1 << 20} {
+			r := NewStrictHMACReader(sha256.New, test.key, limit,
+				bytes.NewReader(test.stream))
+			got, err := ioutil.ReadAll(r)
+			if err != test.err || len(got) != 0 {
+				t.Errorf("Test %v, max %v: strict read %v bytes, %v",
+					k, limit, len(got), err)
+			}
+			if _, err := r.Read(make([]byte, 1)); err != test.err {
+				t.Errorf("Test %v, max %v: error didn't stick: %v", k, limit, err)
+			}
+			r.Close()
+		}
+	}
+	// Test the special cases.
+	if NewHMACWriter(nil, key, &bytes.Buffer{}) != nil {
+		t.Errorf("nil hash didn't return nil.")
+	}
+	if NewHMACWriter(sha256.New, key, nil) != nil {
+		t.Errorf("nil io.Writer didn't return nil.")
+	}
+	if NewHMACReader(nil, key, &bytes.Buffer{}) != nil {
+		t.Errorf("nil hash didn't return nil.")
+	}
+	if NewHMACReader(sha256.New, key, nil) != nil {
+		t.Errorf("nil io.Reader didn't return nil.")
+	}
+	if NewStrictHMACReader(sha256.New, key, 0, nil) != nil {
+		t.Errorf("nil io.Reader didn't return nil.")
+	}
+}
+
+func TestHMACWriterErrors(t *testing.T) {
+	e := fmt.Errorf("i did it")
+	f := &failWriter{ok: 1, err: e}
+	w := NewHMACWriter(sha256.New, []byte("key"), f)
+	w.Write([]byte("first"))
+	for x := 0; x < 2; x++ {
+		if n, err := w.Write([]byte("second")); n != 0 || err != e {
+			t.Errorf("Write %v: got (%v, %v), expected (0, %v)", x, n, err, e)
+		}
+	}
+	// The MAC isn't written after a failed write, even if the writer
+	// would take it.
+	f.ok = 1
+	for x := 0; x < 2; x++ {
+		if err := w.Close(); err != e {
+			t.Errorf("Close %v: err (%v) != expected (%v)", x, err, e)
+		}
+	}
+	if f.String() != "first" {
+		t.Errorf("wrote '%v', expected 'first'", f.String())
+	}
+}
+
+func TestStrictHMACReaderSpool(t *testing.T) {
+	key := []byte("key")
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	buf := &bytes.Buffer{}
+	w := NewHMACWriter(sha256.New, key, buf)
+	w.Write(data)
+	w.Close()
+	stream := buf.Bytes()
+	// Once it spills over, the data lives in a temp file until it's
+	// all been read or we close it.
+	for _, readAll := range []bool{true, false} {
+		r := NewStrictHMACReader(sha256.New, key, 100, bytes.NewReader(stream))
+		p := make([]byte, 10)
+		if n, err := r.Read(p); n != 10 || err != nil {
+			t.Fatalf("first read returned %v %v", n, err)
+		}
+		s := r.(*strictHMACReader).s
+		if s.mem.Len() > 100 || s.f == nil {
+			t.Fatalf("data didn't spill over: %v %v", s.mem.Len(), s.f)
+		}
+		name := s.f.Name()
+		if readAll {
+			got, err := ioutil.ReadAll(r)
+			if err != nil || !bytes.Equal(append(p, got...), data) {
+				t.Errorf("read %v bytes, %v", len(got)+10, err)
+			}
+		} else {
+			r.Close()
+		}
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("temp file wasn't removed (read all: %v): %v", readAll, err)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2014 Joshua Marsh. All rights reserved. Use of this
+// source code is governed by the MIT license that can be found in the
+// LICENSE file.
+
+package wrapio
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io"
+	"sort"
+	"sync"
+)
+
+// MultiHash maintains several named hashes of the same stream of
+// data. It is updated with each read/write operation. The results
+// shouldn't be accessed until the I/O is complete.
+type MultiHash struct {
+	// ParallelThreshold controls hashing in parallel. If it is greater
+	// than zero, any read or write at least this long has each hash
+	// updated in its own goroutine. It should be set before any I/O
+	// is done.
+	ParallelThreshold int
+
+	names  []string
+	hashes map[string]hash.Hash
+}
+
+func newMultiHash(hashes map[string]hash.Hash) *MultiHash {
+	if len(hashes) == 0 {
+		return nil
+	}
+	m := &MultiHash{hashes: make(map[string]hash.Hash, len(hashes))}
+	for name, h := range hashes {
+		if h == nil {
+			return nil
+		}
+		m.names = append(m.names, name)
+		m.hashes[name] = h
+	}
+	sort.Strings(m.names)
+	return m
+}
+
+func (m *MultiHash) update(p []byte) {
+	if m.ParallelThreshold <= 0 || len(p) < m.ParallelThreshold ||
+		len(m.names) < 2 {
+		for _, name := range m.names {
+			m.hashes[name].Write(p)
+		}
+		return
+	}
+	// We have to wait for all of them because p may be reused as soon
+	// as we return.
+	var wg sync.WaitGroup
+	wg.Add(len(m.names))
+	for _, name := range m.names {
+		go func(h hash.Hash) {
+			defer wg.Done()
+			h.Write(p)
+		}(m.hashes[name])
+	}
+	wg.Wait()
+}
+
+// Names returns the sorted names of the hashes.
+func (m *MultiHash) Names() []string {
+	return append([]string(nil), m.names...)
+}
+
+// Sum returns the digest for the hash with the given name. If there
+// is no hash by that name, nil is returned.
+func (m *MultiHash) Sum(name string) []byte {
+	h, ok := m.hashes[name]
+	if !ok {
+		return nil
+	}
+	return h.Sum(nil)
+}
+
+// Hex returns the digest for the hash with the given name as a
+// hexadecimal string. If there is no hash by that name, an empty
+// string is returned.
+func (m *MultiHash) Hex(name string) string {
+	return hex.EncodeToString(m.Sum(name))
+}
+
+// Base64 returns the digest for the hash with the given name as a
+// standard base64 string. If there is no hash by that name, an empty
+// string is returned.
+func (m *MultiHash) Base64(name string) string {
+	return base64.StdEncoding.EncodeToString(m.Sum(name))
+}
+
+// NewMultiHashReader returns an io.Reader that wraps the given
+// io.Reader with the returned set of hashes. Any Read() operations
+// will be written to every one of the hashes with a single handler
+// call. If any of the parameters are nil or there are no hashes, nil
+// is returned for both.
+func NewMultiHashReader(hashes map[string]hash.Hash,
+	r io.Reader) (*MultiHash, io.Reader) {
+	m := newMultiHash(hashes)
+	if m == nil || r == nil {
+		return nil, nil
+	}
+	return m, NewFuncReader(m.update, r)
+}
+
+// NewMultiHashWriter returns an io.Writer that wraps the given
+// io.Writer with the returned set of hashes. Any Write() operations
+// will be written to every one of the hashes with a single handler
+// call. If any of the parameters are nil or there are no hashes, nil
+// is returned for both.
+func NewMultiHashWriter(hashes map[string]hash.Hash,
+	w io.Writer) (*MultiHash, io.Writer) {
+	m := newMultiHash(hashes)
+	if m == nil || w == nil {
+		return nil, nil
+	}
+	return m, NewFuncWriter(m.update, w)
+}
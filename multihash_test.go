@@ -0,0 +1,90 @@
+// Copyright 2014 Joshua Marsh. All rights reserved. Use of this
+// source code is governed by the MIT license that can be found in the
+// LICENSE file.
+
+package wrapio
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func ExampleNewMultiHashReader() {
+	r := strings.NewReader("This is the sample data that we are going to test with.")
+	m, mr := NewMultiHashReader(map[string]hash.Hash{
+		"md5":    md5.New(),
+		"sha256": sha256.New(),
+		"crc32c": crc32.New(crc32.MakeTable(crc32.Castagnoli)),
+	}, r)
+	io.Copy(ioutil.Discard, mr)
+	for _, name := range m.Names() {
+		fmt.Println(name, m.Hex(name))
+	}
+	// Output:
+	// crc32c dc221f51
+	// md5 9bd2f8a51a7745e0e0af586736f93944
+	// sha256 52b846d6fedeb0a90acec7ce09f7d590ec4db0e5bd1884bc74c1d81e3c00b471
+}
+
+func TestMultiHash(t *testing.T) {
+	data := strings.Repeat("I eat pizza for breakfast. ", 100)
+	hashes := func() map[string]hash.Hash {
+		return map[string]hash.Hash{
+			"md5":    md5.New(),
+			"sha256": sha256.New(),
+		}
+	}
+	expected := map[string][]byte{}
+	for name, h := range hashes() {
+		h.Write([]byte(data))
+		expected[name] = h.Sum(nil)
+	}
+	for _, threshold := range []int{0, 1, 1 << 20} {
+		m, r := NewMultiHashReader(hashes(), iotest.HalfReader(strings.NewReader(data)))
+		m.ParallelThreshold = threshold
+		ioutil.ReadAll(r)
+		mw, w := NewMultiHashWriter(hashes(), ioutil.Discard)
+		mw.ParallelThreshold = threshold
+		io.Copy(w, strings.NewReader(data))
+		for name, sum := range expected {
+			if !reflect.DeepEqual(m.Sum(name), sum) {
+				t.Errorf("Threshold %v: reader %v sum %x != expected %x",
+					threshold, name, m.Sum(name), sum)
+			}
+			if !reflect.DeepEqual(mw.Sum(name), sum) {
+				t.Errorf("Threshold %v: writer %v sum %x != expected %x",
+					threshold, name, mw.Sum(name), sum)
+			}
+		}
+	}
+	m, _ := NewMultiHashReader(hashes(), strings.NewReader(""))
+	if m.Base64("md5") != "1B2M2Y8AsgTpgAmY7PhCfg==" {
+		t.Errorf("unexpected base64 for md5: %v", m.Base64("md5"))
+	}
+	if m.Sum("nope") != nil || m.Hex("nope") != "" || m.Base64("nope") != "" {
+		t.Errorf("unknown name didn't return empty results.")
+	}
+	// Test the special error cases.
+	if m, r := NewMultiHashReader(hashes(), nil); m != nil || r != nil {
+		t.Errorf("nil io.Reader didn't return nil.")
+	}
+	if m, w := NewMultiHashWriter(hashes(), nil); m != nil || w != nil {
+		t.Errorf("nil io.Writer didn't return nil.")
+	}
+	if m, r := NewMultiHashReader(nil, strings.NewReader("")); m != nil || r != nil {
+		t.Errorf("no hashes didn't return nil.")
+	}
+	bad := map[string]hash.Hash{"md5": md5.New(), "nil": nil}
+	if m, w := NewMultiHashWriter(bad, ioutil.Discard); m != nil || w != nil {
+		t.Errorf("nil hash didn't return nil.")
+	}
+}
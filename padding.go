@@ -0,0 +1,224 @@
+// Copyright 2014 Joshua Marsh. All rights reserved. Use of this
+// source code is governed by the MIT license that can be found in the
+// LICENSE file.
+
+package wrapio
+
+import (
+	"crypto/subtle"
+)
+
+// Padding is a scheme for filling out the last block of data for a
+// block cipher.
+type Padding interface {
+	// Pad appends padding to p so that its length is a multiple of
+	// blockSize and returns the result. It assumes p is the end of the
+	// stream and that everything before it was a multiple of
+	// blockSize.
+	Pad(p []byte, blockSize int) []byte
+
+	// Unpad removes the padding from the end of p, whose length should
+	// be a multiple of blockSize, and returns the result. A
+	// *PaddingError is returned if the padding isn't valid.
+	Unpad(p []byte, blockSize int) ([]byte, error)
+}
+
+// PaddingError is returned when padding is invalid. It purposely
+// doesn't say what was wrong with it.
+type PaddingError struct {
+	Scheme string // The name of the padding scheme.
+}
+
+// Error implements the error interface.
+func (e *PaddingError) Error() string {
+	return "wrapio: invalid " + e.Scheme + " padding"
+}
+
+// PadFunc returns a handler for NewLastFuncReader or
+// NewLastFuncWriter that pads the last chunk of data with the given
+// padding.
+func PadFunc(pad Padding, blockSize int) func([]byte) []byte {
+	return func(p []byte) []byte {
+		return pad.Pad(p, blockSize)
+	}
+}
+
+// UnpadFunc returns a handler for NewLastFuncReaderE or
+// NewLastFuncWriterE that removes the given padding from the last
+// chunk of data and reports invalid padding as an error.
+func UnpadFunc(pad Padding, blockSize int) func([]byte) ([]byte, error) {
+	return func(p []byte) ([]byte, error) {
+		return pad.Unpad(p, blockSize)
+	}
+}
+
+// validLength reports whether p has a length that can be unpadded for
+// the given block size.
+func validLength(p []byte, blockSize int) bool {
+	return len(p) > 0 && blockSize > 0 && len(p)%blockSize == 0
+}
+
+// PKCS7Padding pads with n bytes that each have the value n, as
+// described in RFC 5652. There is always at least one byte of
+// padding, so aligned data gets a whole block of it. The block size
+// must be less than 256. Unpad runs in constant time with respect to
+// the contents of the last block.
+var PKCS7Padding Padding = pkcs7Padding{}
+
+type pkcs7Padding struct{}
+
+func (pkcs7Padding) Pad(p []byte, blockSize int) []byte {
+	n := blockSize - len(p)%blockSize
+	for x := 0; x < n; x++ {
+		p = append(p, byte(n))
+	}
+	return p
+}
+
+func (pkcs7Padding) Unpad(p []byte, blockSize int) ([]byte, error) {
+	l := len(p)
+	if !validLength(p, blockSize) || blockSize > 255 {
+		return nil, &PaddingError{Scheme: "PKCS#7"}
+	}
+	// We look at every byte of the last block no matter what we find
+	// so the time taken doesn't give away where the padding went bad.
+	n := int(p[l-1])
+	good := subtle.ConstantTimeLessOrEq(1, n) &
+		subtle.ConstantTimeLessOrEq(n, blockSize)
+	for x := 0; x < blockSize; x++ {
+		inPad := subtle.ConstantTimeLessOrEq(x+1, n)
+		match := subtle.ConstantTimeByteEq(p[l-1-x], byte(n))
+		good &= subtle.ConstantTimeSelect(inPad, match, 1)
+	}
+	if good != 1 {
+		return nil, &PaddingError{Scheme: "PKCS#7"}
+	}
+	return p[:l-n], nil
+}
+
+// ISO7816Padding pads with a single 0x80 byte followed by as many
+// zeros as it takes to fill the block, as described in ISO/IEC
+// 7816-4. There is always at least one byte of padding. Unpad runs in
+// constant time with respect to the contents of the last block.
+var ISO7816Padding Padding = iso7816Padding{}
+
+type iso7816Padding struct{}
+
+func (iso7816Padding) Pad(p []byte, blockSize int) []byte {
+	n := blockSize - len(p)%blockSize
+	p = append(p, 0x80)
+	for x := 1; x < n; x++ {
+		p = append(p, 0x00)
+	}
+	return p
+}
+
+func (iso7816Padding) Unpad(p []byte, blockSize int) ([]byte, error) {
+	l := len(p)
+	if !validLength(p, blockSize) {
+		return nil, &PaddingError{Scheme: "ISO/IEC 7816-4"}
+	}
+	// Walking back from the end, we want zeros until the first 0x80.
+	// We keep going to the start of the block either way.
+	found, bad, n := 0, 0, 0
+	for x := 0; x < blockSize; x++ {
+		b := p[l-1-x]
+		is80 := subtle.ConstantTimeByteEq(b, 0x80)
+		is00 := subtle.ConstantTimeByteEq(b, 0x00)
+		searching := found ^ 1
+		hit := searching & is80
+		n = subtle.ConstantTimeSelect(hit, x+1, n)
+		bad |= searching & (is80 ^ 1) & (is00 ^ 1)
+		found |= hit
+	}
+	if found&(bad^1) != 1 {
+		return nil, &PaddingError{Scheme: "ISO/IEC 7816-4"}
+	}
+	return p[:l-n], nil
+}
+
+// ANSIX923Padding pads with zeros followed by a byte holding the
+// number of padding bytes, as described in ANSI X9.23. There is always
+// at least one byte of padding. The block size must be less than 256.
+// Unpad runs in constant time with respect to the contents of the
+// last block.
+var ANSIX923Padding Padding = ansiX923Padding{}
+
+type ansiX923Padding struct{}
+
+func (ansiX923Padding) Pad(p []byte, blockSize int) []byte {
+	n := blockSize - len(p)%blockSize
+	for x := 1; x < n; x++ {
+		p = append(p, 0x00)
+	}
+	return append(p, byte(n))
+}
+
+func (ansiX923Padding) Unpad(p []byte, blockSize int) ([]byte, error) {
+	l := len(p)
+	if !validLength(p, blockSize) || blockSize > 255 {
+		return nil, &PaddingError{Scheme: "ANSI X9.23"}
+	}
+	n := int(p[l-1])
+	good := subtle.ConstantTimeLessOrEq(1, n) &
+		subtle.ConstantTimeLessOrEq(n, blockSize)
+	for x := 1; x < blockSize; x++ {
+		inPad := subtle.ConstantTimeLessOrEq(x+1, n)
+		zero := subtle.ConstantTimeByteEq(p[l-1-x], 0x00)
+		good &= subtle.ConstantTimeSelect(inPad, zero, 1)
+	}
+	if good != 1 {
+		return nil, &PaddingError{Scheme: "ANSI X9.23"}
+	}
+	return p[:l-n], nil
+}
+
+// ZeroPadding pads with zeros, and doesn't pad data that is already
+// a multiple of the block size. Unpad removes all of the trailing
+// zeros from the last block, so it can't be used for data that may
+// end in zeros. The only invalid input is a length that isn't a
+// multiple of the block size.
+var ZeroPadding Padding = zeroPadding{}
+
+type zeroPadding struct{}
+
+func (zeroPadding) Pad(p []byte, blockSize int) []byte {
+	if len(p)%blockSize == 0 {
+		return p
+	}
+	n := blockSize - len(p)%blockSize
+	for x := 0; x < n; x++ {
+		p = append(p, 0x00)
+	}
+	return p
+}
+
+func (zeroPadding) Unpad(p []byte, blockSize int) ([]byte, error) {
+	l := len(p)
+	if blockSize < 1 || l%blockSize != 0 {
+		return nil, &PaddingError{Scheme: "zero"}
+	}
+	n := l
+	for n > 0 && n > l-blockSize && p[n-1] == 0x00 {
+		n--
+	}
+	return p[:n], nil
+}
+
+// NoPadding doesn't pad at all. Pad returns the data as is, so the
+// block wrappers report ErrPartialBlock if it isn't a multiple of the
+// block size. Unpad only checks the length.
+var NoPadding Padding = noPadding{}
+
+type noPadding struct{}
+
+func (noPadding) Pad(p []byte, blockSize int) []byte {
+	return p
+}
+
+func (noPadding) Unpad(p []byte, blockSize int) ([]byte, error) {
+	if blockSize < 1 || len(p)%blockSize != 0 {
+		return nil, &PaddingError{Scheme: "none"}
+	}
+	return p, nil
+}
@@ -0,0 +1,156 @@
+// Copyright 2014 Joshua Marsh. All rights reserved. Use of this
+// source code is governed by the MIT license that can be found in the
+// LICENSE file.
+
+package wrapio
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestPKCS7Padding(t *testing.T) {
+	tests := []struct {
+		data   string
+		padded string
+	}{
+		{data: "", padded: "\x04\x04\x04\x04"},
+		{data: "a", padded: "a\x03\x03\x03"},
+		{data: "abc", padded: "abc\x01"},
+		{data: "abcd", padded: "abcd\x04\x04\x04\x04"},
+		{data: "abcde", padded: "abcde\x03\x03\x03"},
+	}
+	for k, test := range tests {
+		p := PKCS7Padding.Pad([]byte(test.data), 4)
+		if string(p) != test.padded {
+			t.Errorf("Test %v: padded %q != expected %q", k, p, test.padded)
+		}
+		u, err := PKCS7Padding.Unpad(p, 4)
+		if err != nil || string(u) != test.data {
+			t.Errorf("Test %v: unpadded %q %v != expected %q",
+				k, u, err, test.data)
+		}
+	}
+	for k, bad := range []string{
+		"", "abc", "abc\x00", "abc\x05", "ab\x01\x02", "a\x03\x02\x03",
+	} {
+		u, err := PKCS7Padding.Unpad([]byte(bad), 4)
+		if _, ok := err.(*PaddingError); !ok || u != nil {
+			t.Errorf("Test %v: bad padding %q returned %q %v", k, bad, u, err)
+		}
+	}
+	// The error shouldn't say what went wrong.
+	_, err := PKCS7Padding.Unpad([]byte("abc\x05"), 4)
+	if err.Error() != "wrapio: invalid PKCS#7 padding" {
+		t.Errorf("unexpected error message: %v", err)
+	}
+	// Unpad only looks at the end.
+	u, _ := PKCS7Padding.Unpad([]byte("\x01\x01\x01\x01abc\x01"), 4)
+	if !bytes.Equal(u, []byte("\x01\x01\x01\x01abc")) {
+		t.Errorf("unexpected unpad of multiple blocks: %q", u)
+	}
+}
+
+func TestPaddings(t *testing.T) {
+	tests := []struct {
+		pad    Padding
+		data   string
+		padded string
+	}{
+		{pad: ISO7816Padding, data: "", padded: "\x80\x00\x00\x00"},
+		{pad: ISO7816Padding, data: "abc", padded: "abc\x80"},
+		{pad: ISO7816Padding, data: "ab\x80\x00", padded: "ab\x80\x00\x80\x00\x00\x00"},
+		{pad: ANSIX923Padding, data: "", padded: "\x00\x00\x00\x04"},
+		{pad: ANSIX923Padding, data: "a", padded: "a\x00\x00\x03"},
+		{pad: ANSIX923Padding, data: "abcd", padded: "abcd\x00\x00\x00\x04"},
+		{pad: ZeroPadding, data: "", padded: ""},
+		{pad: ZeroPadding, data: "a", padded: "a\x00\x00\x00"},
+		{pad: ZeroPadding, data: "abcd", padded: "abcd"},
+		{pad: NoPadding, data: "", padded: ""},
+		{pad: NoPadding, data: "abcd", padded: "abcd"},
+	}
+	for k, test := range tests {
+		p := test.pad.Pad([]byte(test.data), 4)
+		if string(p) != test.padded {
+			t.Errorf("Test %v: padded %q != expected %q", k, p, test.padded)
+		}
+		u, err := test.pad.Unpad(p, 4)
+		if err != nil || string(u) != test.data {
+			t.Errorf("Test %v: unpadded %q %v != expected %q",
+				k, u, err, test.data)
+		}
+	}
+	bad := []struct {
+		pad  Padding
+		data string
+	}{
+		{pad: ISO7816Padding, data: ""},
+		{pad: ISO7816Padding, data: "abc"},
+		{pad: ISO7816Padding, data: "abc\x00"},
+		{pad: ISO7816Padding, data: "\x80\x00\x01\x00"},
+		{pad: ISO7816Padding, data: "\x00\x00\x00\x00"},
+		{pad: ANSIX923Padding, data: ""},
+		{pad: ANSIX923Padding, data: "abc\x00"},
+		{pad: ANSIX923Padding, data: "abc\x05"},
+		{pad: ANSIX923Padding, data: "a\x01\x00\x03"},
+		{pad: ZeroPadding, data: "abc"},
+		{pad: NoPadding, data: "abc"},
+	}
+	for k, test := range bad {
+		u, err := test.pad.Unpad([]byte(test.data), 4)
+		if _, ok := err.(*PaddingError); !ok || u != nil {
+			t.Errorf("Test %v: bad padding %q returned %q %v", k, test.data, u, err)
+		}
+	}
+	// Zero padding strips at most one block.
+	u, _ := ZeroPadding.Unpad([]byte("\x00\x00\x00\x00\x00\x00\x00\x00"), 4)
+	if len(u) != 4 {
+		t.Errorf("zero padding stripped %v bytes", 8-len(u))
+	}
+}
+
+func TestPaddingFuncs(t *testing.T) {
+	// Pad through a last func writer and unpad through a last func
+	// reader.
+	buf := &bytes.Buffer{}
+	w := NewLastFuncWriter(PadFunc(ISO7816Padding, 4), buf)
+	w.Write([]byte("0123"))
+	w.Write([]byte("45"))
+	w.Close()
+	if buf.String() != "012345\x80\x00" {
+		t.Errorf("unexpected padded output: %q", buf.String())
+	}
+	r := NewLastFuncReaderE(UnpadFunc(ISO7816Padding, 4), NewBlockReader(4, buf))
+	out := &bytes.Buffer{}
+	p := make([]byte, 4)
+	var err error
+	for err == nil {
+		var n int
+		n, err = r.Read(p)
+		out.Write(p[:n])
+	}
+	if out.String() != "012345" || err != io.EOF {
+		t.Errorf("unexpected unpadded output: %q %v", out.String(), err)
+	}
+	// Bad padding is reported in place of EOF.
+	r = NewLastFuncReaderE(UnpadFunc(ISO7816Padding, 4),
+		NewBlockReader(4, bytes.NewReader([]byte("01234567"))))
+	out.Reset()
+	err = nil
+	for err == nil {
+		var n int
+		n, err = r.Read(p)
+		out.Write(p[:n])
+	}
+	if _, ok := err.(*PaddingError); !ok || out.String() != "0123" {
+		t.Errorf("bad padding returned %q %v", out.String(), err)
+	}
+	// And from Close() on the writer.
+	w = NewLastFuncWriterE(UnpadFunc(ISO7816Padding, 4), ioutil.Discard)
+	w.Write([]byte("0123"))
+	if _, ok := w.Close().(*PaddingError); !ok {
+		t.Errorf("bad padding wasn't returned from close")
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2014 Joshua Marsh. All rights reserved. Use of this
+// source code is governed by the MIT license that can be found in the
+// LICENSE file.
+
+package wrapio
+
+import (
+	"io"
+	"time"
+)
+
+// Progress describes how far along a stream is. It is handed to the
+// callback given to NewProgressReader.
+type Progress struct {
+	Done    int64         // The number of bytes read so far.
+	Total   int64         // The expected number of bytes, or <= 0 if unknown.
+	Percent float64       // Done as a percent of Total, or -1 if Total is unknown.
+	Rate    float64       // The bytes per second over roughly the last second.
+	ETA     time.Duration // The estimated time left, or -1 if it can't be estimated.
+	Elapsed time.Duration // The time since the reader was created.
+	Final   bool          // True on the last callback.
+	Err     error         // The error that ended the stream on the last callback.
+}
+
+// Progress implements the io.Reader interface.
+type progress struct {
+	s        *Stats
+	r        io.Reader
+	total    int64
+	interval time.Duration
+	cb       func(Progress)
+	start    time.Time
+	last     time.Time // When the callback was last called.
+	done     bool      // Set once the final callback is made.
+}
+
+func (p *progress) report(now time.Time, err error, final bool) {
+	snap := p.s.Snapshot()
+	pr := Progress{
+		Done:    int64(snap.Total),
+		Total:   p.total,
+		Percent: -1,
+		Rate:    snap.MovingRate(time.Second),
+		ETA:     -1,
+		Elapsed: now.Sub(p.start),
+		Final:   final,
+		Err:     err,
+	}
+	if p.total > 0 {
+		pr.Percent = 100 * float64(pr.Done) / float64(p.total)
+		if left := p.total - pr.Done; left <= 0 {
+			pr.ETA = 0
+		} else if pr.Rate > 0 {
+			pr.ETA = time.Duration(float64(left) / pr.Rate * float64(time.Second))
+		}
+	}
+	p.last = now
+	p.cb(pr)
+}
+
+// Read implements the io.Reader interface.
+func (p *progress) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if p.done {
+		return n, err
+	}
+	now := p.s.clock()
+	if err != nil {
+		p.done = true
+		p.report(now, err, true)
+	} else if now.Sub(p.last) >= p.interval {
+		p.report(now, nil, false)
+	}
+	return n, err
+}
+
+// ProgressOption changes how the reader returned by NewProgressReader
+// behaves.
+type ProgressOption func(*progress)
+
+// ProgressClock replaces time.Now, which is useful for testing code
+// that reports progress. It's used for Elapsed, the rate and the
+// interval between callbacks. A nil function leaves the real one in
+// place.
+func ProgressClock(now func() time.Time) ProgressOption {
+	return func(p *progress) {
+		p.s.now = now
+	}
+}
+
+// NewProgressReader returns an io.Reader that reports its progress by
+// calling cb. The callback is called from inside Read() at most once
+// per interval, and always one last time with Final set when the
+// given io.Reader returns an error (including io.EOF). The total is
+// the expected size of the stream and is used for the percent and
+// ETA. If it is unknown, pass zero. If either r or cb are nil, nil is
+// returned.
+func NewProgressReader(r io.Reader, total int64, interval time.Duration,
+	cb func(Progress), opts ...ProgressOption) io.Reader {
+	if r == nil || cb == nil {
+		return nil
+	}
+	s, sr := NewStatsReader(r)
+	p := &progress{
+		s:        s,
+		r:        sr,
+		total:    total,
+		interval: interval,
+		cb:       cb,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	p.start = s.clock()
+	p.last = p.start
+	return p
+}
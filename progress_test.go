@@ -0,0 +1,66 @@
+// Copyright 2014 Joshua Marsh. All rights reserved. Use of this
+// source code is governed by the MIT license that can be found in the
+// LICENSE file.
+
+package wrapio
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgressReader(t *testing.T) {
+	c := newFakeClock()
+	var got []Progress
+	r := NewProgressReader(
+		&slowReader{c: c, d: 300 * time.Millisecond, n: 100, left: 1000},
+		1000, time.Second, func(p Progress) {
+			got = append(got, p)
+		}, ProgressClock(c.Now))
+	io.Copy(ioutil.Discard, r)
+	// 11 reads 300ms apart means callbacks at 1.2s, 2.4s and 3.3s
+	// (the final one).
+	if len(got) != 3 {
+		t.Fatalf("got %v callbacks, expected 3: %+v", len(got), got)
+	}
+	first := got[0]
+	if first.Done != 400 || first.Percent != 40 || first.Final ||
+		first.Elapsed != 1200*time.Millisecond {
+		t.Errorf("unexpected first callback: %+v", first)
+	}
+	if first.Rate <= 0 || first.ETA <= 0 {
+		t.Errorf("rate (%v) and ETA (%v) weren't estimated", first.Rate, first.ETA)
+	}
+	last := got[len(got)-1]
+	if last.Done != 1000 || last.Percent != 100 || last.ETA != 0 ||
+		!last.Final || last.Err != io.EOF {
+		t.Errorf("unexpected final callback: %+v", last)
+	}
+	// Reading after the end shouldn't call back again.
+	r.Read(make([]byte, 10))
+	if len(got) != 3 {
+		t.Errorf("callback made after the final one")
+	}
+	// Errors end it too, and an unknown total can't be estimated.
+	e := fmt.Errorf("i did it")
+	var final Progress
+	r = NewProgressReader(er{n: 5, err: e}, 0, time.Hour, func(p Progress) {
+		final = p
+	})
+	r.Read(make([]byte, 10))
+	if !final.Final || final.Err != e || final.Done != 5 ||
+		final.Percent != -1 || final.ETA != -1 {
+		t.Errorf("unexpected error callback: %+v", final)
+	}
+	// Test the special error cases.
+	if NewProgressReader(nil, 0, time.Second, func(Progress) {}) != nil {
+		t.Errorf("nil io.Reader didn't return nil.")
+	}
+	if NewProgressReader(strings.NewReader(""), 0, time.Second, nil) != nil {
+		t.Errorf("nil func didn't return nil.")
+	}
+}
@@ -0,0 +1,302 @@
+// Copyright 2014 Joshua Marsh. All rights reserved. Use of this
+// source code is governed by the MIT license that can be found in the
+// LICENSE file.
+
+package wrapio
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	metricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNameRE  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// Registry holds named Stats so they can be rendered in the
+// Prometheus text exposition format. It implements http.Handler, so
+// it can be mounted directly:
+//
+//	r := wrapio.NewRegistry()
+//	s, body := wrapio.NewStatsReader(resp.Body)
+//	r.Register("download", map[string]string{"host": "a"}, s)
+//	http.Handle("/metrics", r)
+type Registry struct {
+	mu      sync.Mutex
+	entries map[string]registryEntry // Keyed by the name and labels.
+}
+
+type registryEntry struct {
+	name   string
+	labels string // The rendered labels without braces.
+	s      *Stats
+}
+
+// DefaultRegistry is a Registry for programs that only need one.
+var DefaultRegistry = NewRegistry()
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{entries: map[string]registryEntry{}}
+}
+
+// renderLabels validates the labels and renders them in sorted order
+// in the form a="b",c="d".
+func renderLabels(labels map[string]string) (string, error) {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		if !labelNameRE.MatchString(k) || strings.HasPrefix(k, "__") ||
+			k == "le" {
+			return "", fmt.Errorf("wrapio: invalid label name %q", k)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for x, k := range keys {
+		parts[x] = k + `="` + labelEscaper.Replace(labels[k]) + `"`
+	}
+	return strings.Join(parts, ","), nil
+}
+
+// Register adds the Stats under the given metric name and labels. The
+// name is used as the prefix for each of the metrics rendered for
+// it. An error is returned if the name or labels are invalid, if the
+// name and labels are already registered or if any of the metrics for
+// the name would have the same name as one for a different registered
+// name, like "foo_zero_calls_total" for "foo" and "foo_zero".
+func (r *Registry) Register(name string, labels map[string]string,
+	s *Stats) error {
+	if s == nil {
+		return fmt.Errorf("wrapio: nil stats")
+	}
+	if !metricNameRE.MatchString(name) {
+		return fmt.Errorf("wrapio: invalid metric name %q", name)
+	}
+	l, err := renderLabels(labels)
+	if err != nil {
+		return err
+	}
+	key := name + "{" + l + "}"
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.entries[key]; ok {
+		return fmt.Errorf("wrapio: %s is already registered", key)
+	}
+	names := map[string]bool{}
+	for _, n := range metricNames(name) {
+		names[n] = true
+	}
+	for _, e := range r.entries {
+		if e.name == name {
+			continue
+		}
+		for _, n := range metricNames(e.name) {
+			if names[n] {
+				return fmt.Errorf("wrapio: %s for %q is already used by %q",
+					n, name, e.name)
+			}
+		}
+	}
+	r.entries[key] = registryEntry{name: name, labels: l, s: s}
+	return nil
+}
+
+// Unregister removes the Stats registered under the given name and
+// labels. It returns false if there wasn't one.
+func (r *Registry) Unregister(name string, labels map[string]string) bool {
+	l, err := renderLabels(labels)
+	if err != nil {
+		return false
+	}
+	key := name + "{" + l + "}"
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.entries[key]
+	delete(r.entries, key)
+	return ok
+}
+
+// WriteTo writes all of the registered Stats to w in the Prometheus
+// text exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	entries := make([]registryEntry, 0, len(r.entries))
+	for _, e := range r.entries {
+		entries = append(entries, e)
+	}
+	r.mu.Unlock()
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].name != entries[j].name {
+			return entries[i].name < entries[j].name
+		}
+		return entries[i].labels < entries[j].labels
+	})
+	// Take the snapshots up front so every metric for a Stats agrees.
+	snaps := make([]Snapshot, len(entries))
+	for x, e := range entries {
+		snaps[x] = e.s.Snapshot()
+	}
+	cw := &countWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	// Each metric family has to be written out in one group, so we
+	// loop over the names and then the entries for each of them.
+	for start := 0; start < len(entries); {
+		end := start
+		for end < len(entries) && entries[end].name == entries[start].name {
+			end++
+		}
+		writeFamilies(bw, entries[start:end], snaps[start:end])
+		start = end
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// countWriter counts the bytes written to the writer it wraps.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+// Write implements the io.Writer interface.
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// ServeHTTP implements the http.Handler interface. The metrics are
+// rendered before anything is sent, so a failure is reported as a 500
+// rather than a partial body.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var buf bytes.Buffer
+	if _, err := r.WriteTo(&buf); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// joinLabels puts the two rendered label sets together in braces.
+func joinLabels(a, b string) string {
+	switch {
+	case a == "" && b == "":
+		return ""
+	case a == "":
+		return "{" + b + "}"
+	case b == "":
+		return "{" + a + "}"
+	}
+	return "{" + a + "," + b + "}"
+}
+
+// promSimple are the metrics rendered for each name that have a
+// single value.
+var promSimple = []struct {
+	suffix string
+	kind   string
+	help   string
+	value  func(Snapshot) int
+}{
+	{"_bytes_total", "counter", "Bytes that have passed through.",
+		func(s Snapshot) int { return s.Total }},
+	{"_calls_total", "counter", "Calls to Read or Write that moved data.",
+		func(s Snapshot) int { return s.Calls }},
+	{"_zero_calls_total", "counter", "Calls to Read or Write that moved no data.",
+		func(s Snapshot) int { return s.ZeroCalls }},
+	{"_error_calls_total", "counter", "Calls to Read or Write that returned an error.",
+		func(s Snapshot) int { return s.ErrorCalls }},
+	{"_in_flight", "gauge", "Calls to Read or Write running right now.",
+		func(s Snapshot) int { return s.InFlight }},
+}
+
+// promThrottled is the suffix of the throttled time metric.
+const promThrottled = "_throttled_seconds_total"
+
+// promHists are the histograms rendered for each name.
+var promHists = []struct {
+	suffix string
+	help   string
+	scale  float64
+	value  func(Snapshot) Histogram
+}{
+	{"_call_size_bytes", "Bytes moved by each call to Read or Write.", 1,
+		func(s Snapshot) Histogram { return s.Sizes }},
+	{"_call_duration_seconds", "Time each call to Read or Write took.", 1e9,
+		func(s Snapshot) Histogram { return s.Latencies }},
+}
+
+// metricNames returns the names of every metric family and series
+// rendered for the given name.
+func metricNames(name string) []string {
+	names := []string{name + promThrottled}
+	for _, m := range promSimple {
+		names = append(names, name+m.suffix)
+	}
+	for _, m := range promHists {
+		names = append(names, name+m.suffix, name+m.suffix+"_bucket",
+			name+m.suffix+"_sum", name+m.suffix+"_count")
+	}
+	return names
+}
+
+func writeFamilies(w io.Writer, entries []registryEntry, snaps []Snapshot) {
+	name := entries[0].name
+	for _, m := range promSimple {
+		fmt.Fprintf(w, "# HELP %s%s %s\n# TYPE %s%s %s\n",
+			name, m.suffix, m.help, name, m.suffix, m.kind)
+		for x, e := range entries {
+			fmt.Fprintf(w, "%s%s%s %d\n",
+				name, m.suffix, joinLabels(e.labels, ""), m.value(snaps[x]))
+		}
+	}
+	fmt.Fprintf(w, "# HELP %s%s Time spent waiting on a rate limiter.\n"+
+		"# TYPE %s%s counter\n", name, promThrottled, name, promThrottled)
+	for x, e := range entries {
+		fmt.Fprintf(w, "%s%s%s %s\n", name, promThrottled,
+			joinLabels(e.labels, ""),
+			strconv.FormatFloat(snaps[x].Throttled.Seconds(), 'g', -1, 64))
+	}
+	for _, m := range promHists {
+		fmt.Fprintf(w, "# HELP %s%s %s\n# TYPE %s%s histogram\n",
+			name, m.suffix, m.help, name, m.suffix)
+		for x, e := range entries {
+			writeHistogram(w, name+m.suffix, e.labels, m.value(snaps[x]), m.scale)
+		}
+	}
+}
+
+// writeHistogram writes out the cumulative buckets up to the largest
+// one in use. The values are divided by scale.
+func writeHistogram(w io.Writer, name, labels string, h Histogram,
+	scale float64) {
+	last := 0
+	for x, c := range h.counts {
+		if c > 0 {
+			last = x
+		}
+	}
+	var seen uint64
+	for x := 0; x <= last && x < histBuckets-1; x++ {
+		seen += h.counts[x]
+		le := strconv.FormatFloat(float64(bucketMax(x))/scale, 'g', -1, 64)
+		fmt.Fprintf(w, "%s_bucket%s %d\n",
+			name, joinLabels(labels, `le="`+le+`"`), seen)
+	}
+	fmt.Fprintf(w, "%s_bucket%s %d\n", name, joinLabels(labels, `le="+Inf"`), h.count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, joinLabels(labels, ""),
+		strconv.FormatFloat(float64(h.sum)/scale, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, joinLabels(labels, ""), h.count)
+}
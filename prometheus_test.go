@@ -0,0 +1,148 @@
+// Copyright 2014 Joshua Marsh. All rights reserved. Use of this
+// source code is governed by the MIT license that can be found in the
+// LICENSE file.
+
+package wrapio
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	a, ar := NewStatsReader(strings.NewReader("0123456789"))
+	ioutil.ReadAll(ar)
+	b, bw := NewStatsWriter(ioutil.Discard)
+	bw.Write([]byte("012"))
+	bw.Write(nil)
+	if err := r.Register("wrapio_test", map[string]string{"dir": "in"}, a); err != nil {
+		t.Fatalf("unexpected register error: %v", err)
+	}
+	if err := r.Register("wrapio_test", map[string]string{"dir": "out\"\n"}, b); err != nil {
+		t.Fatalf("unexpected register error: %v", err)
+	}
+	if err := r.Register("other", nil, b); err != nil {
+		t.Fatalf("unexpected register error: %v", err)
+	}
+	s := httptest.NewServer(r)
+	defer s.Close()
+	resp, err := http.Get(s.URL)
+	if err != nil {
+		t.Fatalf("unexpected get error: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type: %v", ct)
+	}
+	out := string(body)
+	expected := []string{
+		"# TYPE other_bytes_total counter\nother_bytes_total 3\n",
+		"# TYPE wrapio_test_bytes_total counter\n" +
+			"wrapio_test_bytes_total{dir=\"in\"} 10\n" +
+			"wrapio_test_bytes_total{dir=\"out\\\"\\n\"} 3\n",
+		"wrapio_test_calls_total{dir=\"in\"} 1\n",
+		"wrapio_test_zero_calls_total{dir=\"in\"} 1\n",
+		"wrapio_test_zero_calls_total{dir=\"out\\\"\\n\"} 1\n",
+		"wrapio_test_error_calls_total{dir=\"in\"} 0\n",
+		"# TYPE wrapio_test_in_flight gauge\n",
+		"# TYPE wrapio_test_throttled_seconds_total counter\n" +
+			"wrapio_test_throttled_seconds_total{dir=\"in\"} 0\n",
+		"# TYPE wrapio_test_call_size_bytes histogram\n" +
+			"wrapio_test_call_size_bytes_bucket{dir=\"in\",le=\"0\"} 1\n" +
+			"wrapio_test_call_size_bytes_bucket{dir=\"in\",le=\"1\"} 1\n" +
+			"wrapio_test_call_size_bytes_bucket{dir=\"in\",le=\"3\"} 1\n" +
+			"wrapio_test_call_size_bytes_bucket{dir=\"in\",le=\"7\"} 1\n" +
+			"wrapio_test_call_size_bytes_bucket{dir=\"in\",le=\"15\"} 2\n" +
+			"wrapio_test_call_size_bytes_bucket{dir=\"in\",le=\"+Inf\"} 2\n" +
+			"wrapio_test_call_size_bytes_sum{dir=\"in\"} 10\n" +
+			"wrapio_test_call_size_bytes_count{dir=\"in\"} 2\n",
+		"# TYPE wrapio_test_call_duration_seconds histogram\n",
+	}
+	for x, e := range expected {
+		if !strings.Contains(out, e) {
+			t.Errorf("Test %v: output missing:\n%v\nin:\n%v", x, e, out)
+		}
+	}
+	// Each family should only be described once.
+	if n := strings.Count(out, "# TYPE wrapio_test_bytes_total"); n != 1 {
+		t.Errorf("family described %v times", n)
+	}
+	// Registration problems.
+	if r.Register("wrapio_test", map[string]string{"dir": "in"}, a) == nil {
+		t.Errorf("duplicate registration didn't fail")
+	}
+	if r.Register("bad-name", nil, a) == nil {
+		t.Errorf("bad name didn't fail")
+	}
+	if r.Register("ok", map[string]string{"le": "1"}, a) == nil {
+		t.Errorf("reserved label didn't fail")
+	}
+	if r.Register("ok", nil, nil) == nil {
+		t.Errorf("nil stats didn't fail")
+	}
+	// Names whose metrics would collide.
+	if r.Register("wrapio_test_zero", nil, a) == nil {
+		t.Errorf("overlapping name didn't fail")
+	}
+	if r.Register("wrapio", nil, a) != nil {
+		t.Errorf("name that doesn't overlap failed")
+	}
+	if r.Register("wrapio_test_call_size", nil, a) != nil {
+		t.Errorf("name that doesn't overlap failed")
+	}
+	r.Unregister("wrapio", nil)
+	r.Unregister("wrapio_test_call_size", nil)
+	if !r.Unregister("other", nil) || r.Unregister("other", nil) {
+		t.Errorf("unexpected unregister results")
+	}
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if strings.Contains(rec.Body.String(), "other_") {
+		t.Errorf("unregistered stats still rendered")
+	}
+	// WriteTo counts what it wrote and passes errors along.
+	buf := &bytes.Buffer{}
+	if n, err := r.WriteTo(buf); n != int64(buf.Len()) || err != nil {
+		t.Errorf("WriteTo returned %v %v, wrote %v bytes", n, err, buf.Len())
+	}
+	e := ew{err: fmt.Errorf("i did it")}
+	if n, err := r.WriteTo(e); n != 0 || err != e.err {
+		t.Errorf("failing WriteTo returned %v %v", n, err)
+	}
+}
+
+func TestRegistryInFlight(t *testing.T) {
+	// Block a read so we can see it in flight.
+	pr, pw := io.Pipe()
+	s, r := NewStatsReader(pr)
+	reg := NewRegistry()
+	reg.Register("blocked", nil, s)
+	done := make(chan struct{})
+	go func() {
+		r.Read(make([]byte, 1))
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Snapshot().InFlight != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	buf := &strings.Builder{}
+	reg.WriteTo(buf)
+	if !strings.Contains(buf.String(), "blocked_in_flight 1\n") {
+		t.Errorf("in flight gauge wasn't 1:\n%v", buf.String())
+	}
+	pw.Write([]byte("x"))
+	<-done
+	if s.Snapshot().InFlight != 0 {
+		t.Errorf("in flight didn't drop back to 0")
+	}
+}
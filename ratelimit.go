@@ -0,0 +1,251 @@
+// Copyright 2014 Joshua Marsh. All rights reserved. Use of this
+// source code is governed by the MIT license that can be found in the
+// LICENSE file.
+
+package wrapio
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket that limits the bytes per second going
+// through the readers and writers made from it. Tokens are added at
+// the limit up to the burst size, and each byte takes one. Several
+// streams can share a Limiter to split one budget between them. It is
+// safe to use from multiple goroutines.
+//
+// A Limiter keeps Stats for everything going through it, including how
+// long the calls were throttled.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64 // Bytes per second, unlimited if <= 0.
+	burst  int
+	tokens float64 // Negative when calls are waiting on them.
+	last   time.Time
+	stats  *Stats
+
+	now   func() time.Time    // Set by SetClock() in place of time.Now.
+	sleep func(time.Duration) // Set by SetClock() in place of time.Sleep.
+}
+
+// NewLimiter returns a Limiter that allows bytesPerSec bytes per second
+// with bursts of up to burst bytes. It starts out full. A limit of
+// zero or less means no limit. If burst is less than 1, nil is
+// returned.
+func NewLimiter(bytesPerSec float64, burst int) *Limiter {
+	if burst < 1 {
+		return nil
+	}
+	return &Limiter{rate: bytesPerSec, burst: burst,
+		tokens: float64(burst), stats: newStats()}
+}
+
+// SetClock replaces time.Now and time.Sleep for the Limiter and its
+// Stats, which is useful for testing code that uses it. A nil function
+// puts back the real one. It isn't safe to call while the Limiter is
+// being used.
+func (l *Limiter) SetClock(now func() time.Time, sleep func(time.Duration)) {
+	l.now = now
+	l.sleep = sleep
+	l.stats.now = now
+}
+
+func (l *Limiter) clock() time.Time {
+	if l.now != nil {
+		return l.now()
+	}
+	return time.Now()
+}
+
+func (l *Limiter) wait(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	if l.sleep != nil {
+		l.sleep(d)
+		return
+	}
+	time.Sleep(d)
+}
+
+// advance adds the tokens earned since the last call. The lock must be
+// held.
+func (l *Limiter) advance(now time.Time) {
+	if !l.last.IsZero() && l.rate > 0 {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+	}
+	if l.tokens > float64(l.burst) || l.rate <= 0 {
+		l.tokens = float64(l.burst)
+	}
+	l.last = now
+}
+
+// reserve takes n tokens and returns how long to wait before using
+// them.
+func (l *Limiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.advance(l.clock())
+	if l.rate <= 0 {
+		return 0
+	}
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// Limit returns the bytes per second allowed.
+func (l *Limiter) Limit() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// SetLimit changes the bytes per second allowed. Zero or less means no
+// limit. Calls that are already waiting aren't affected.
+func (l *Limiter) SetLimit(bytesPerSec float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.advance(l.clock())
+	l.rate = bytesPerSec
+}
+
+// Burst returns the largest number of bytes allowed at once.
+func (l *Limiter) Burst() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.burst
+}
+
+// SetBurst changes the largest number of bytes allowed at once. Values
+// less than 1 are ignored.
+func (l *Limiter) SetBurst(burst int) {
+	if burst < 1 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.advance(l.clock())
+	l.burst = burst
+	if l.tokens > float64(burst) {
+		l.tokens = float64(burst)
+	}
+}
+
+// chunk returns the most bytes a single call can move, or 0 if there
+// is no limit.
+func (l *Limiter) chunk() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	return l.burst
+}
+
+// Stats returns the Stats for all the readers and writers made from
+// the Limiter. Snapshot.Throttled is the total time they spent
+// waiting.
+func (l *Limiter) Stats() *Stats {
+	return l.stats
+}
+
+// limited implements the io.Reader and io.Writer interface.
+type limited struct {
+	l *Limiter
+	r io.Reader
+	w io.Writer
+}
+
+// Read implements the io.Reader interface. Reads are limited to the
+// burst size when there is a limit and the wait happens after the data
+// is read, so we never take tokens for data we didn't get.
+func (l *limited) Read(p []byte) (int, error) {
+	if c := l.l.chunk(); c > 0 && len(p) > c {
+		p = p[:c]
+	}
+	s := l.l.stats
+	s.inFlight.Add(1)
+	defer s.inFlight.Add(-1)
+	start := s.clock()
+	n, err := l.r.Read(p)
+	s.record(n, err, s.clock().Sub(start))
+	d := l.l.reserve(n)
+	l.l.wait(d)
+	s.throttled.Add(int64(d))
+	return n, err
+}
+
+// Write implements the io.Writer interface. Writes are split into
+// chunks of the burst size when there is a limit and we wait before
+// each one.
+func (l *limited) Write(p []byte) (int, error) {
+	s := l.l.stats
+	s.inFlight.Add(1)
+	defer s.inFlight.Add(-1)
+	written := 0
+	for written < len(p) {
+		chunk := p[written:]
+		if c := l.l.chunk(); c > 0 && len(chunk) > c {
+			chunk = chunk[:c]
+		}
+		d := l.l.reserve(len(chunk))
+		l.l.wait(d)
+		s.throttled.Add(int64(d))
+		start := s.clock()
+		n, err := l.w.Write(chunk)
+		s.record(n, err, s.clock().Sub(start))
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Reader returns an io.Reader that reads from the given reader within
+// the Limiter's budget. If the reader is nil, nil is returned.
+func (l *Limiter) Reader(r io.Reader) io.Reader {
+	if r == nil {
+		return nil
+	}
+	return &limited{l: l, r: r}
+}
+
+// Writer returns an io.Writer that writes to the given writer within
+// the Limiter's budget. If the writer is nil, nil is returned.
+func (l *Limiter) Writer(w io.Writer) io.Writer {
+	if w == nil {
+		return nil
+	}
+	return &limited{l: l, w: w}
+}
+
+// NewRateLimitedReader returns an io.Reader that reads from the given
+// io.Reader at no more than bytesPerSec bytes per second with bursts
+// of up to burst bytes. The returned Limiter can change the limit
+// while it's being read and share it with other streams. If the reader
+// is nil or burst is less than 1, nil is returned for both.
+func NewRateLimitedReader(r io.Reader, bytesPerSec float64,
+	burst int) (*Limiter, io.Reader) {
+	l := NewLimiter(bytesPerSec, burst)
+	if l == nil || r == nil {
+		return nil, nil
+	}
+	return l, l.Reader(r)
+}
+
+// NewRateLimitedWriter is the io.Writer version of
+// NewRateLimitedReader.
+func NewRateLimitedWriter(w io.Writer, bytesPerSec float64,
+	burst int) (*Limiter, io.Writer) {
+	l := NewLimiter(bytesPerSec, burst)
+	if l == nil || w == nil {
+		return nil, nil
+	}
+	return l, l.Writer(w)
+}
@@ -0,0 +1,161 @@
+// Copyright 2014 Joshua Marsh. All rights reserved. Use of this
+// source code is governed by the MIT license that can be found in the
+// LICENSE file.
+
+package wrapio
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// fakeLimiter returns a Limiter that runs on the given clock.
+func fakeLimiter(c *fakeClock, bytesPerSec float64, burst int) *Limiter {
+	l := NewLimiter(bytesPerSec, burst)
+	l.SetClock(c.Now, c.Advance)
+	return l
+}
+
+func TestRateLimitedReader(t *testing.T) {
+	c := newFakeClock()
+	start := c.Now()
+	l := fakeLimiter(c, 10000, 1000)
+	r := l.Reader(bytes.NewReader(make([]byte, 10000)))
+	p := make([]byte, 4096)
+	// The first 1000 bytes are free, then each 1000 takes 100ms.
+	for x := 0; x < 5; x++ {
+		if n, err := r.Read(p); n != 1000 || err != nil {
+			t.Fatalf("read %v returned %v %v", x, n, err)
+		}
+	}
+	if d := c.Now().Sub(start); d != ms(400) {
+		t.Errorf("5000 bytes took %v, expected %v", d, ms(400))
+	}
+	// Halving the limit doubles the time.
+	l.SetLimit(5000)
+	if l.Limit() != 5000 {
+		t.Errorf("Limit() (%v) != expected (%v)", l.Limit(), 5000)
+	}
+	if n, err := io.CopyBuffer(ioutil.Discard, r, p); n != 5000 || err != nil {
+		t.Errorf("copy returned %v %v", n, err)
+	}
+	if d := c.Now().Sub(start); d != ms(1400) {
+		t.Errorf("10000 bytes took %v, expected %v", d, ms(1400))
+	}
+	snap := l.Stats().Snapshot()
+	if snap.Total != 10000 || snap.Throttled != ms(1400) {
+		t.Errorf("unexpected stats: %v %v", snap.Total, snap.Throttled)
+	}
+	// Test the special cases.
+	if l, r := NewRateLimitedReader(nil, 1, 1); l != nil || r != nil {
+		t.Errorf("nil io.Reader didn't return nil.")
+	}
+	if l, r := NewRateLimitedReader(&bytes.Buffer{}, 1, 0); l != nil || r != nil {
+		t.Errorf("zero burst didn't return nil.")
+	}
+	if l, r := NewRateLimitedReader(&bytes.Buffer{}, 1, 1); l == nil || r == nil {
+		t.Errorf("valid parameters returned nil.")
+	}
+}
+
+func TestRateLimitedWriter(t *testing.T) {
+	c := newFakeClock()
+	start := c.Now()
+	l := fakeLimiter(c, 10000, 1000)
+	buf := &bytes.Buffer{}
+	w := l.Writer(buf)
+	if n, err := w.Write(make([]byte, 10000)); n != 10000 || err != nil {
+		t.Errorf("write returned %v %v", n, err)
+	}
+	if d := c.Now().Sub(start); d != ms(900) || buf.Len() != 10000 {
+		t.Errorf("10000 bytes took %v, expected %v", d, ms(900))
+	}
+	if snap := l.Stats().Snapshot(); snap.Calls != 10 || snap.Throttled != ms(900) {
+		t.Errorf("unexpected stats: %v %v", snap.Calls, snap.Throttled)
+	}
+	// Idle time refills the bucket, but only up to the burst.
+	c.Advance(time.Hour)
+	start = c.Now()
+	w.Write(make([]byte, 2000))
+	if d := c.Now().Sub(start); d != ms(100) {
+		t.Errorf("2000 bytes after idling took %v", d)
+	}
+	// Errors are returned.
+	_, ew := NewRateLimitedWriter(ew{err: io.ErrShortWrite}, 1, 1)
+	if n, err := ew.Write([]byte("abc")); n != 0 || err != io.ErrShortWrite {
+		t.Errorf("bad error writer results: %v %v", n, err)
+	}
+	// Test the special cases.
+	if l, w := NewRateLimitedWriter(nil, 1, 1); l != nil || w != nil {
+		t.Errorf("nil io.Writer didn't return nil.")
+	}
+	if l, w := NewRateLimitedWriter(ioutil.Discard, 1, 0); l != nil || w != nil {
+		t.Errorf("zero burst didn't return nil.")
+	}
+}
+
+// ms returns the given number of milliseconds as a time.Duration.
+func ms(n int) time.Duration {
+	return time.Duration(n) * time.Millisecond
+}
+
+func TestLimiterShared(t *testing.T) {
+	c := newFakeClock()
+	start := c.Now()
+	l := fakeLimiter(c, 10000, 1000)
+	a, b := l.Writer(ioutil.Discard), l.Writer(ioutil.Discard)
+	// Two streams split the budget, so together they take as long as
+	// one would.
+	for x := 0; x < 5; x++ {
+		a.Write(make([]byte, 1000))
+		b.Write(make([]byte, 1000))
+	}
+	if el := c.Now().Sub(start); el != ms(900) {
+		t.Errorf("shared streams took %v, expected %v", el, ms(900))
+	}
+	// A smaller burst splits writes further and drops saved tokens.
+	c.Advance(time.Second)
+	l.SetBurst(100)
+	l.SetBurst(0)
+	if l.Burst() != 100 {
+		t.Errorf("Burst() (%v) != expected (%v)", l.Burst(), 100)
+	}
+	start = c.Now()
+	a.Write(make([]byte, 1000))
+	if el := c.Now().Sub(start); el != ms(90) {
+		t.Errorf("small burst took %v, expected %v", el, ms(90))
+	}
+	if snap := l.Stats().Snapshot(); snap.Calls != 20 {
+		t.Errorf("Calls (%v) != expected (%v)", snap.Calls, 20)
+	}
+	// No limit means no waiting and no splitting.
+	l.SetLimit(0)
+	l.Stats().Reset()
+	start = c.Now()
+	rw := &recordWriter{}
+	if n, err := l.Writer(rw).Write(make([]byte, 100000)); n != 100000 || err != nil {
+		t.Errorf("unlimited write returned %v %v", n, err)
+	}
+	if el := c.Now().Sub(start); el != 0 {
+		t.Errorf("unlimited stream waited %v", el)
+	}
+	if len(rw.writes) != 1 {
+		t.Errorf("unlimited write was split into %v writes", len(rw.writes))
+	}
+	r := l.Reader(bytes.NewReader(make([]byte, 100000)))
+	if n, err := r.Read(make([]byte, 4096)); n != 4096 || err != nil {
+		t.Errorf("unlimited read returned %v %v", n, err)
+	}
+	if snap := l.Stats().Snapshot(); snap.Calls != 2 {
+		t.Errorf("Calls (%v) != expected (%v)", snap.Calls, 2)
+	}
+	if NewLimiter(1, 0) != nil {
+		t.Errorf("zero burst didn't return nil.")
+	}
+	if l.Reader(nil) != nil || l.Writer(nil) != nil {
+		t.Errorf("nil io.Reader or io.Writer didn't return nil.")
+	}
+}
@@ -0,0 +1,423 @@
+// Copyright 2014 Joshua Marsh. All rights reserved. Use of this
+// source code is governed by the MIT license that can be found in the
+// LICENSE file.
+
+package wrapio
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// rateWindows are the windows over which Stats tracks a moving rate.
+var rateWindows = [...]time.Duration{
+	time.Second,
+	10 * time.Second,
+	time.Minute,
+}
+
+// Rates holds exponentially weighted moving rates in bytes per second
+// for each of the rateWindows. Each byte adds 1/window to a rate and
+// the rate decays by a factor of e every window. A steady stream of r
+// bytes per second settles at r.
+type rates struct {
+	rates [len(rateWindows)]float64
+	last  time.Time
+}
+
+// at returns the rates as of the given time.
+func (r *rates) at(t time.Time) [len(rateWindows)]float64 {
+	var out [len(rateWindows)]float64
+	if r == nil || r.last.IsZero() {
+		return out
+	}
+	dt := t.Sub(r.last).Seconds()
+	for x, window := range rateWindows {
+		out[x] = r.rates[x]
+		if dt > 0 {
+			out[x] *= math.Exp(-dt / window.Seconds())
+		}
+	}
+	return out
+}
+
+// add returns new rates with n bytes added at the given time.
+func (r *rates) add(n int, t time.Time) *rates {
+	nr := &rates{rates: r.at(t), last: t}
+	for x, window := range rateWindows {
+		nr.rates[x] += float64(n) / window.Seconds()
+	}
+	return nr
+}
+
+// histBuckets is the number of buckets in a Histogram. Bucket 0 holds
+// zero and bucket x holds values in [2^(x-1), 2^x).
+const histBuckets = 64
+
+func bucketFor(v int64) int {
+	if v <= 0 {
+		return 0
+	}
+	return bits.Len64(uint64(v))
+}
+
+// bucketMax returns the largest value that bucket x can hold.
+func bucketMax(x int) int64 {
+	if x >= histBuckets-1 {
+		return math.MaxInt64
+	}
+	return 1<<uint(x) - 1
+}
+
+// Histogram is a log-bucketed histogram of non-negative values. Each
+// bucket covers twice the range of the one before it, so quantiles
+// are approximate. They are reported as the largest value the bucket
+// they fall into could hold.
+type Histogram struct {
+	counts [histBuckets]uint64
+	count  uint64
+	sum    int64
+}
+
+// Count returns the number of values in the histogram.
+func (h Histogram) Count() uint64 {
+	return h.count
+}
+
+// Sum returns the sum of the values in the histogram.
+func (h Histogram) Sum() int64 {
+	return h.sum
+}
+
+// Quantile returns the approximate value below which the given
+// fraction (0 to 1) of the values fall. It returns zero if the
+// histogram is empty.
+func (h Histogram) Quantile(q float64) int64 {
+	if h.count == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(h.count)))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen uint64
+	for x, c := range h.counts {
+		seen += c
+		if seen >= rank {
+			return bucketMax(x)
+		}
+	}
+	return bucketMax(histBuckets - 1)
+}
+
+// P50 returns the approximate median.
+func (h Histogram) P50() int64 {
+	return h.Quantile(0.5)
+}
+
+// P90 returns the approximate 90th percentile.
+func (h Histogram) P90() int64 {
+	return h.Quantile(0.9)
+}
+
+// P99 returns the approximate 99th percentile.
+func (h Histogram) P99() int64 {
+	return h.Quantile(0.99)
+}
+
+// sub returns the values in h that aren't in prev.
+func (h Histogram) sub(prev Histogram) Histogram {
+	for x := range h.counts {
+		h.counts[x] -= prev.counts[x]
+	}
+	h.count -= prev.count
+	h.sum -= prev.sum
+	return h
+}
+
+// AtomicHistogram is the lock-free version of Histogram that Stats
+// updates.
+type atomicHistogram struct {
+	counts [histBuckets]atomic.Uint64
+	sum    atomic.Int64
+}
+
+func (h *atomicHistogram) observe(v int64) {
+	h.counts[bucketFor(v)].Add(1)
+	h.sum.Add(v)
+}
+
+func (h *atomicHistogram) load() Histogram {
+	var out Histogram
+	for x := range h.counts {
+		out.counts[x] = h.counts[x].Load()
+		out.count += out.counts[x]
+	}
+	out.sum = h.sum.Load()
+	return out
+}
+
+func (h *atomicHistogram) reset() {
+	for x := range h.counts {
+		h.counts[x].Store(0)
+	}
+	h.sum.Store(0)
+}
+
+// Snapshot is a copy of the statistics at a moment in time. It is
+// safe to use without any synchronization.
+//
+// Calls, ZeroCalls and ErrorCalls overlap. A Read that returns data
+// along with an error is counted in both Calls and ErrorCalls. io.EOF
+// isn't counted as an error.
+type Snapshot struct {
+	Total      int       // The total number of bytes that have passed through.
+	Average    float64   // The average number of bytes read or written per call.
+	Calls      int       // The number of calls to Read or Write that moved data.
+	ZeroCalls  int       // The number of calls that moved no data.
+	ErrorCalls int       // The number of calls that returned an error.
+	InFlight   int       // The number of calls running right now.
+	Start      time.Time // When the stats were created, reset or first updated.
+	Last       time.Time // When the last Read or Write happened.
+	Taken      time.Time // When the snapshot was taken.
+	Sizes      Histogram // The number of bytes moved by each call.
+	Latencies  Histogram // The nanoseconds each underlying call took.
+
+	// Throttled is the time spent waiting on a Limiter.
+	Throttled time.Duration
+
+	rates [len(rateWindows)]float64 // The moving rates as of Taken.
+}
+
+// String implements the fmt.Stringer interface.
+func (s Snapshot) String() string {
+	return fmt.Sprintf("[Total: %d, Average: %f, Calls: %d]",
+		s.Total, s.Average, s.Calls)
+}
+
+// Throughput returns the number of bytes per second from Start to
+// Last. It is zero until some time has passed between the two.
+func (s Snapshot) Throughput() float64 {
+	d := s.Last.Sub(s.Start).Seconds()
+	if d <= 0 {
+		return 0
+	}
+	return float64(s.Total) / d
+}
+
+// MovingRate returns an exponentially weighted moving average of the
+// bytes per second over the given window as of when the snapshot was
+// taken. The rate decays while the stream is idle, which makes it
+// useful for spotting stalled transfers. Only windows of time.Second,
+// 10*time.Second and time.Minute are tracked. Any other window
+// returns zero.
+func (s Snapshot) MovingRate(window time.Duration) float64 {
+	for x, w := range rateWindows {
+		if w == window {
+			return s.rates[x]
+		}
+	}
+	return 0
+}
+
+// Stats maintains the statistics about the I/O. It is updated with
+// each read/write operation without locking, so it is safe to call
+// Snapshot() at any time, even while the I/O is happening.
+type Stats struct {
+	total      atomic.Int64
+	calls      atomic.Int64
+	zeroCalls  atomic.Int64
+	errorCalls atomic.Int64
+	inFlight   atomic.Int64
+	start      atomic.Int64 // UnixNano, zero if unset.
+	last       atomic.Int64 // UnixNano, zero if unset.
+	sizes      atomicHistogram
+	latencies  atomicHistogram
+	rates      atomic.Pointer[rates]
+	throttled  atomic.Int64 // Nanoseconds.
+
+	now func() time.Time // Used in place of time.Now when testing.
+}
+
+// String implements the fmt.Stringer interface.
+func (s *Stats) String() string {
+	return s.Snapshot().String()
+}
+
+func (s *Stats) clock() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// record updates the stats with the results of a single call to the
+// underlying Read or Write that took d to run.
+func (s *Stats) record(n int, err error, d time.Duration) {
+	t := s.clock()
+	s.start.CompareAndSwap(0, unixNano(t))
+	s.last.Store(unixNano(t))
+	s.sizes.observe(int64(n))
+	s.latencies.observe(int64(d))
+	if err != nil && err != io.EOF {
+		s.errorCalls.Add(1)
+	}
+	if n == 0 {
+		s.zeroCalls.Add(1)
+		return
+	}
+	s.total.Add(int64(n))
+	s.calls.Add(1)
+	for {
+		old := s.rates.Load()
+		if s.rates.CompareAndSwap(old, old.add(n, t)) {
+			break
+		}
+	}
+}
+
+// Snapshot returns a copy of the current statistics. Each value is
+// read atomically, but a call that is in progress may show up in some
+// of them and not others.
+func (s *Stats) Snapshot() Snapshot {
+	snap := Snapshot{
+		Total:      int(s.total.Load()),
+		Calls:      int(s.calls.Load()),
+		ZeroCalls:  int(s.zeroCalls.Load()),
+		ErrorCalls: int(s.errorCalls.Load()),
+		InFlight:   int(s.inFlight.Load()),
+		Start:      fromUnixNano(s.start.Load()),
+		Last:       fromUnixNano(s.last.Load()),
+		Taken:      s.clock(),
+		Sizes:      s.sizes.load(),
+		Latencies:  s.latencies.load(),
+		Throttled:  time.Duration(s.throttled.Load()),
+	}
+	snap.rates = s.rates.Load().at(snap.Taken)
+	if snap.Calls > 0 {
+		snap.Average = float64(snap.Total) / float64(snap.Calls)
+	}
+	return snap
+}
+
+// Reset clears the statistics and starts them over from now. Calls
+// that are in progress during a Reset may be split across the old and
+// new values.
+func (s *Stats) Reset() {
+	s.total.Store(0)
+	s.calls.Store(0)
+	s.zeroCalls.Store(0)
+	s.errorCalls.Store(0)
+	s.start.Store(unixNano(s.clock()))
+	s.last.Store(0)
+	s.sizes.reset()
+	s.latencies.reset()
+	s.rates.Store(nil)
+	s.throttled.Store(0)
+}
+
+// Delta returns a snapshot of what happened since prev was taken. The
+// counters and histograms only include the calls since then, Start is
+// when prev was taken and the moving rates are the current ones. It's
+// meant for reporting at intervals:
+//
+//	prev := s.Snapshot()
+//	for range ticker.C {
+//		d := s.Delta(prev)
+//		prev = s.Snapshot()
+//		log.Println(d, d.Throughput())
+//	}
+//
+// If Reset was called after prev was taken, the results are
+// meaningless.
+func (s *Stats) Delta(prev Snapshot) Snapshot {
+	cur := s.Snapshot()
+	cur.Total -= prev.Total
+	cur.Calls -= prev.Calls
+	cur.ZeroCalls -= prev.ZeroCalls
+	cur.ErrorCalls -= prev.ErrorCalls
+	cur.Sizes = cur.Sizes.sub(prev.Sizes)
+	cur.Latencies = cur.Latencies.sub(prev.Latencies)
+	cur.Throttled -= prev.Throttled
+	cur.Start = prev.Taken
+	cur.Average = 0
+	if cur.Calls > 0 {
+		cur.Average = float64(cur.Total) / float64(cur.Calls)
+	}
+	return cur
+}
+
+// StatsIO implements the io.Reader and io.Writer interface.
+type statsIO struct {
+	s *Stats
+	r io.Reader
+	w io.Writer
+}
+
+// Read implements the io.Reader interface.
+func (s *statsIO) Read(p []byte) (int, error) {
+	s.s.inFlight.Add(1)
+	defer s.s.inFlight.Add(-1)
+	start := s.s.clock()
+	n, err := s.r.Read(p)
+	s.s.record(n, err, s.s.clock().Sub(start))
+	return n, err
+}
+
+// Write implements the io.Writer interface.
+func (s *statsIO) Write(p []byte) (int, error) {
+	s.s.inFlight.Add(1)
+	defer s.s.inFlight.Add(-1)
+	start := s.s.clock()
+	n, err := s.w.Write(p)
+	s.s.record(n, err, s.s.clock().Sub(start))
+	return n, err
+}
+
+func newStats() *Stats {
+	s := &Stats{}
+	s.start.Store(time.Now().UnixNano())
+	return s
+}
+
+// NewStatsReader returns an io.Reader that wraps the given io.Reader
+// with the returned statistical analyzer. Every Read() operation is
+// timed and analyzed and the statistics updated. If either of the
+// parameters are nil, nil is returned.
+func NewStatsReader(r io.Reader) (*Stats, io.Reader) {
+	s := newStats()
+	if r == nil {
+		return s, nil
+	}
+	return s, &statsIO{s: s, r: r}
+}
+
+// NewStatsWriter returns an io.Writer that wraps the given io.Writer
+// with the returned statistical analyzer. Every Write() operation is
+// timed and analyzed and the statistics updated. If either of the
+// parameters are nil, nil is returned.
+func NewStatsWriter(w io.Writer) (*Stats, io.Writer) {
+	s := newStats()
+	if w == nil {
+		return s, nil
+	}
+	return s, &statsIO{s: s, w: w}
+}
@@ -0,0 +1,265 @@
+// Copyright 2014 Joshua Marsh. All rights reserved. Use of this
+// source code is governed by the MIT license that can be found in the
+// LICENSE file.
+
+package wrapio
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a time source that only moves when told to.
+type fakeClock struct {
+	t time.Time
+}
+
+func (f *fakeClock) Now() time.Time {
+	return f.t
+}
+
+func (f *fakeClock) Advance(d time.Duration) {
+	f.t = f.t.Add(d)
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{t: time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func TestStatsAverage(t *testing.T) {
+	s := &Stats{}
+	s.record(1, nil, 0)
+	s.record(2, nil, 0)
+	if a := s.Snapshot().Average; a != 1.5 {
+		t.Errorf("Average (%v) != expected (%v)", a, 1.5)
+	}
+}
+
+func TestStatsRates(t *testing.T) {
+	c := newFakeClock()
+	s := &Stats{now: c.Now}
+	s.start.Store(c.Now().UnixNano())
+	snap := s.Snapshot()
+	if snap.Throughput() != 0 || snap.MovingRate(time.Second) != 0 {
+		t.Errorf("rates weren't zero before any I/O")
+	}
+	// Send 1000 bytes every 100ms for 10 minutes (10,000 B/s).
+	p := make([]byte, 1000)
+	for x := 0; x < 6000; x++ {
+		c.Advance(100 * time.Millisecond)
+		s.record(len(p), nil, 0)
+	}
+	snap = s.Snapshot()
+	if !snap.Last.Equal(c.Now()) || !snap.Taken.Equal(c.Now()) {
+		t.Errorf("Last (%v) and Taken (%v) != expected (%v)",
+			snap.Last, snap.Taken, c.Now())
+	}
+	if snap.Throughput() != 10000 {
+		t.Errorf("Throughput (%v) != expected (%v)", snap.Throughput(), 10000)
+	}
+	for _, w := range rateWindows {
+		// A discrete stream wobbles around the real rate a little.
+		if r := snap.MovingRate(w); math.Abs(r-10000) > 10000*0.06 {
+			t.Errorf("MovingRate(%v) (%v) isn't close to %v", w, r, 10000)
+		}
+	}
+	if snap.MovingRate(time.Hour) != 0 {
+		t.Errorf("untracked window didn't return zero")
+	}
+	// Now go idle. The short window should drop off quickly, while
+	// the lifetime throughput is unchanged.
+	c.Advance(10 * time.Second)
+	snap = s.Snapshot()
+	if r := snap.MovingRate(time.Second); r > 1 {
+		t.Errorf("MovingRate(1s) (%v) didn't decay while idle", r)
+	}
+	if r := snap.MovingRate(time.Minute); r < 8000 {
+		t.Errorf("MovingRate(1m) (%v) decayed too quickly", r)
+	}
+	if snap.Throughput() != 10000 {
+		t.Errorf("Throughput (%v) changed while idle", snap.Throughput())
+	}
+}
+
+func TestStatsResetDelta(t *testing.T) {
+	c := newFakeClock()
+	s := &Stats{now: c.Now}
+	for x := 0; x < 4; x++ {
+		c.Advance(time.Second)
+		s.record(10, nil, time.Millisecond)
+	}
+	s.throttled.Add(int64(time.Second))
+	prev := s.Snapshot()
+	s.throttled.Add(int64(time.Second))
+	for x := 0; x < 2; x++ {
+		c.Advance(time.Second)
+		s.record(30, nil, time.Millisecond)
+	}
+	s.record(0, io.EOF, time.Millisecond)
+	d := s.Delta(prev)
+	if d.Total != 60 || d.Calls != 2 || d.ZeroCalls != 1 || d.Average != 30 {
+		t.Errorf("unexpected delta: %v %v %v %v",
+			d.Total, d.Calls, d.ZeroCalls, d.Average)
+	}
+	if d.Sizes.Count() != 3 || d.Latencies.Count() != 3 || d.Sizes.P90() != 31 {
+		t.Errorf("unexpected delta histograms: %v %v %v",
+			d.Sizes.Count(), d.Latencies.Count(), d.Sizes.P90())
+	}
+	if !d.Start.Equal(prev.Taken) || d.Throughput() != 30 ||
+		d.Throttled != time.Second {
+		t.Errorf("unexpected delta times: %v %v %v",
+			d.Start, d.Throughput(), d.Throttled)
+	}
+	// The snapshot we took shouldn't have changed.
+	if prev.Total != 40 || prev.Sizes.Count() != 4 {
+		t.Errorf("snapshot changed: %v %v", prev.Total, prev.Sizes.Count())
+	}
+	c.Advance(time.Second)
+	s.Reset()
+	snap := s.Snapshot()
+	if snap.Total != 0 || snap.Calls != 0 || snap.ZeroCalls != 0 ||
+		snap.Sizes.Count() != 0 || snap.MovingRate(time.Minute) != 0 ||
+		snap.Throttled != 0 ||
+		!snap.Start.Equal(c.Now()) || !snap.Last.IsZero() {
+		t.Errorf("unexpected stats after reset: %+v", snap)
+	}
+}
+
+func TestStatsConcurrent(t *testing.T) {
+	// This is mostly for the race detector.
+	s, w := NewStatsWriter(ioutil.Discard)
+	var wg sync.WaitGroup
+	for x := 0; x < 4; x++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for y := 0; y < 1000; y++ {
+				w.Write(make([]byte, 8))
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for {
+		select {
+		case <-done:
+			if snap := s.Snapshot(); snap.Total != 32000 || snap.Calls != 4000 {
+				t.Errorf("unexpected totals: %v %v", snap.Total, snap.Calls)
+			}
+			return
+		default:
+			_ = s.Snapshot().String()
+		}
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	ah := &atomicHistogram{}
+	if h := ah.load(); h.P50() != 0 || h.Count() != 0 {
+		t.Errorf("empty histogram didn't return zeros")
+	}
+	// 50 zeros, 40 values in [4, 8) and 10 values in [1024, 2048).
+	for x := 0; x < 50; x++ {
+		ah.observe(0)
+	}
+	for x := 0; x < 40; x++ {
+		ah.observe(int64(4 + x%4))
+	}
+	for x := 0; x < 10; x++ {
+		ah.observe(1500)
+	}
+	h := ah.load()
+	tests := []struct {
+		q        float64
+		expected int64
+	}{
+		{q: 0, expected: 0},
+		{q: 0.5, expected: 0},
+		{q: 0.51, expected: 7},
+		{q: 0.9, expected: 7},
+		{q: 0.99, expected: 2047},
+		{q: 1, expected: 2047},
+	}
+	for k, test := range tests {
+		if v := h.Quantile(test.q); v != test.expected {
+			t.Errorf("Test %v: Quantile(%v) (%v) != expected (%v)",
+				k, test.q, v, test.expected)
+		}
+	}
+	if h.Count() != 100 || h.P90() != 7 || h.P99() != 2047 {
+		t.Errorf("unexpected accessors: %v %v %v", h.Count(), h.P90(), h.P99())
+	}
+	ah.observe(math.MaxInt64)
+	if h = ah.load(); h.Quantile(1) != math.MaxInt64 {
+		t.Errorf("largest bucket (%v) != expected (%v)",
+			h.Quantile(1), int64(math.MaxInt64))
+	}
+}
+
+// slowReader returns n bytes per call and advances the clock by d
+// while doing it.
+type slowReader struct {
+	c    *fakeClock
+	d    time.Duration
+	n    int
+	left int
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	s.c.Advance(s.d)
+	if s.left == 0 {
+		return 0, io.EOF
+	}
+	n := s.n
+	if n > s.left {
+		n = s.left
+	}
+	s.left -= n
+	return n, nil
+}
+
+func TestStatsCalls(t *testing.T) {
+	c := newFakeClock()
+	s, r := NewStatsReader(&slowReader{c: c, d: 3 * time.Millisecond, n: 100, left: 1000})
+	s.now = c.Now
+	p := make([]byte, 1000)
+	for x := 0; x < 12; x++ {
+		r.Read(p)
+	}
+	snap := s.Snapshot()
+	if snap.Calls != 10 || snap.ZeroCalls != 2 || snap.ErrorCalls != 0 {
+		t.Errorf("unexpected call counts: %v %v %v",
+			snap.Calls, snap.ZeroCalls, snap.ErrorCalls)
+	}
+	if snap.Sizes.Count() != 12 || snap.Sizes.P50() != 127 {
+		t.Errorf("unexpected sizes: %v %v", snap.Sizes.Count(), snap.Sizes.P50())
+	}
+	if d := time.Duration(snap.Latencies.P99()); d < 3*time.Millisecond ||
+		d >= 6*time.Millisecond {
+		t.Errorf("unexpected latency: %v", d)
+	}
+	// Errors are counted whether or not data came with them.
+	e := fmt.Errorf("i did it")
+	s, r = NewStatsReader(er{n: 3, err: e})
+	r.Read(p)
+	snap = s.Snapshot()
+	if snap.Calls != 1 || snap.ZeroCalls != 0 || snap.ErrorCalls != 1 {
+		t.Errorf("unexpected reader error call counts: %v %v %v",
+			snap.Calls, snap.ZeroCalls, snap.ErrorCalls)
+	}
+	s, w := NewStatsWriter(ew{err: e})
+	w.Write(p)
+	snap = s.Snapshot()
+	if snap.Calls != 0 || snap.ZeroCalls != 1 || snap.ErrorCalls != 1 {
+		t.Errorf("unexpected error call counts: %v %v %v",
+			snap.Calls, snap.ZeroCalls, snap.ErrorCalls)
+	}
+}
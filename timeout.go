@@ -0,0 +1,341 @@
+// Copyright 2014 Joshua Marsh. All rights reserved. Use of this
+// source code is governed by the MIT license that can be found in the
+// LICENSE file.
+
+package wrapio
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrTimeout matches every *TimeoutError with errors.Is.
+var ErrTimeout = errors.New("wrapio: timeout")
+
+// TimeoutError is returned by the readers and writers from
+// NewTimeoutReader and NewTimeoutWriter when they give up. It has a
+// Timeout method like net.Error.
+type TimeoutError struct {
+	Total bool // True if the total timeout was hit, false if it was the idle one.
+}
+
+// Error implements the error interface.
+func (e *TimeoutError) Error() string {
+	if e.Total {
+		return "wrapio: total timeout exceeded"
+	}
+	return "wrapio: idle timeout exceeded"
+}
+
+// Timeout reports that this is a timeout.
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+// Is makes errors.Is(err, ErrTimeout) true.
+func (e *TimeoutError) Is(target error) bool {
+	return target == ErrTimeout
+}
+
+// timeoutResult is what the helper goroutine sends back.
+type timeoutResult struct {
+	n   int
+	err error
+}
+
+// TimeoutIO implements the io.Closer, io.Reader, and io.Writer
+// interface.
+type timeoutIO struct {
+	r           io.Reader
+	w           io.Writer
+	idle        time.Duration
+	total       time.Duration
+	setDeadline func(time.Time) error // Nil if deadlines aren't supported.
+	start       time.Time             // When the first call was made.
+	buf         []byte                // Owned by the helper while a call is pending.
+	reqs        chan int              // The sizes of calls for the helper to make.
+	res         chan timeoutResult
+	err         error
+	closed      atomic.Bool
+	done        chan struct{} // Closed to release the helper and wake a pending call.
+	once        sync.Once
+	mu          sync.Mutex // Guards pending and deadline.
+	pending     bool       // Set while a call with a deadline is running.
+	deadline    bool       // Set once we've set a deadline.
+
+	now      func() time.Time // Set by TimeoutClock() in place of time.Now.
+	newTimer func(time.Duration) (<-chan time.Time, func() bool)
+}
+
+func (t *timeoutIO) clock() time.Time {
+	if t.now != nil {
+		return t.now()
+	}
+	return time.Now()
+}
+
+func (t *timeoutIO) timer(d time.Duration) (<-chan time.Time, func() bool) {
+	if t.newTimer != nil {
+		return t.newTimer(d)
+	}
+	tm := time.NewTimer(d)
+	return tm.C, tm.Stop
+}
+
+// wait returns how long the next call can take and whether that's
+// limited by the total timeout. Zero means there's no limit.
+func (t *timeoutIO) wait() (time.Duration, bool, error) {
+	now := t.clock()
+	if t.start.IsZero() {
+		t.start = now
+	}
+	if t.total <= 0 {
+		return t.idle, false, nil
+	}
+	left := t.start.Add(t.total).Sub(now)
+	if left <= 0 {
+		return 0, true, &TimeoutError{Total: true}
+	}
+	if t.idle <= 0 || left < t.idle {
+		return left, true, nil
+	}
+	return t.idle, false, nil
+}
+
+// helper makes the calls for us until done is closed.
+func (t *timeoutIO) helper() {
+	for {
+		select {
+		case n := <-t.reqs:
+			var res timeoutResult
+			if t.r != nil {
+				res.n, res.err = t.r.Read(t.buf[:n])
+			} else {
+				res.n, res.err = t.w.Write(t.buf[:n])
+			}
+			// There's room for this, so it never blocks.
+			t.res <- res
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// stop releases the helper once it's done with its current call and
+// wakes up a call waiting on it.
+func (t *timeoutIO) stop() {
+	t.once.Do(func() {
+		close(t.done)
+	})
+}
+
+// do runs the call with the timeouts. For reads, the data is copied
+// to p. For writes, p is copied for the helper. The caller's slice is
+// never handed to the helper, since it may still be using it after we
+// give up.
+func (t *timeoutIO) do(p []byte) (int, error) {
+	if t.closed.Load() {
+		return 0, ErrClosed
+	}
+	if t.err != nil {
+		return 0, t.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	wait, total, err := t.wait()
+	if err != nil {
+		t.err = err
+		t.stop()
+		return 0, err
+	}
+	if wait <= 0 {
+		// No limits, so there's nothing for us to do.
+		if t.r != nil {
+			return t.r.Read(p)
+		}
+		return t.w.Write(p)
+	}
+	if t.setDeadline != nil {
+		return t.doDeadline(p, wait, total)
+	}
+	if t.reqs == nil {
+		t.reqs = make(chan int, 1)
+		t.res = make(chan timeoutResult, 1)
+		go t.helper()
+	}
+	if cap(t.buf) < len(p) {
+		t.buf = make([]byte, len(p))
+	}
+	if t.w != nil {
+		copy(t.buf, p)
+	}
+	t.reqs <- len(p)
+	c, stopTimer := t.timer(wait)
+	defer stopTimer()
+	select {
+	case res := <-t.res:
+		if t.r != nil {
+			copy(p, t.buf[:res.n])
+		}
+		return res.n, res.err
+	case <-c:
+		t.err = &TimeoutError{Total: total}
+		t.stop()
+		return 0, t.err
+	case <-t.done:
+		return 0, ErrClosed
+	}
+}
+
+// doDeadline runs the call with a deadline. If Close() interrupts it,
+// it clears the deadline once the call returns.
+func (t *timeoutIO) doDeadline(p []byte, wait time.Duration,
+	total bool) (int, error) {
+	t.mu.Lock()
+	if t.closed.Load() {
+		t.mu.Unlock()
+		return 0, ErrClosed
+	}
+	if err := t.setDeadline(time.Now().Add(wait)); err != nil {
+		t.mu.Unlock()
+		return 0, err
+	}
+	t.pending, t.deadline = true, true
+	t.mu.Unlock()
+	var n int
+	var err error
+	if t.r != nil {
+		n, err = t.r.Read(p)
+	} else {
+		n, err = t.w.Write(p)
+	}
+	t.mu.Lock()
+	t.pending = false
+	closed := t.closed.Load()
+	if closed {
+		t.setDeadline(time.Time{})
+	}
+	t.mu.Unlock()
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		if closed {
+			return n, ErrClosed
+		}
+		t.err = &TimeoutError{Total: total}
+		err = t.err
+	}
+	return n, err
+}
+
+// Read implements the io.Reader interface.
+func (t *timeoutIO) Read(p []byte) (int, error) {
+	return t.do(p)
+}
+
+// Write implements the io.Writer interface.
+func (t *timeoutIO) Write(p []byte) (int, error) {
+	return t.do(p)
+}
+
+// Close implements the io.Closer interface. It releases the helper
+// goroutine and wakes up a call waiting on it. A call blocked with a
+// deadline is interrupted by moving the deadline into the past and
+// clears it once it returns. Otherwise the deadline is cleared here if
+// we set one.
+func (t *timeoutIO) Close() error {
+	if t.closed.Swap(true) {
+		return nil
+	}
+	t.stop()
+	if t.setDeadline == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.pending {
+		return t.setDeadline(aLongTimeAgo)
+	}
+	if t.deadline {
+		return t.setDeadline(time.Time{})
+	}
+	return nil
+}
+
+// TimeoutOption changes how the readers and writers returned by
+// NewTimeoutReader and NewTimeoutWriter behave. Deadlines are always
+// set using the real time, even with TimeoutClock.
+type TimeoutOption func(*timeoutIO)
+
+// TimeoutClock replaces time.Now and time.NewTimer, which is useful for
+// testing code that uses timeouts. newTimer returns the channel the
+// timer fires on and a function that stops it, like a time.Timer's C
+// and Stop. A nil function leaves the real one in place. Deadlines set
+// on readers and writers that support them still use the real time.
+func TimeoutClock(now func() time.Time,
+	newTimer func(time.Duration) (<-chan time.Time, func() bool)) TimeoutOption {
+	return func(t *timeoutIO) {
+		t.now = now
+		t.newTimer = newTimer
+	}
+}
+
+// NewTimeoutReader returns an io.Reader that gives up on the given
+// io.Reader if a Read() doesn't return within idle or if reading takes
+// longer than total altogether, starting from the first Read(). Either
+// can be zero to turn it off. When it gives up, a *TimeoutError is
+// returned, which matches ErrTimeout with errors.Is, and every Read()
+// after that returns it too.
+//
+// If the reader has a SetReadDeadline method, like net.Conn and
+// *os.File, deadlines are used. Otherwise the reads are done by a
+// helper goroutine into its own buffer and copied to p. The goroutine
+// is started by the first Read() that has a timeout. It exits once
+// the reader is closed or times out and the Read() it is blocked in
+// returns. If that Read() never returns, neither does the goroutine,
+// so it's best to close the underlying source too.
+//
+// The returned reader is also a closer. Closing it releases the
+// goroutine, clears the deadline if one was set and makes Read()
+// return ErrClosed. It does not close the given io.Reader. Close() can
+// be called from another goroutine to stop a Read() that is waiting,
+// which then returns ErrClosed, though a Read() with no timeouts can't
+// be stopped. Otherwise, it is not safe to use from multiple
+// goroutines at once. If the reader is nil, nil is returned.
+func NewTimeoutReader(r io.Reader, idle, total time.Duration,
+	opts ...TimeoutOption) io.ReadCloser {
+	if r == nil {
+		return nil
+	}
+	t := &timeoutIO{r: r, idle: idle, total: total, done: make(chan struct{})}
+	if d, ok := r.(interface{ SetReadDeadline(time.Time) error }); ok {
+		t.setDeadline = d.SetReadDeadline
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
+// NewTimeoutWriter is the io.Writer version of NewTimeoutReader. It
+// uses SetWriteDeadline if the writer has it. Otherwise p is copied
+// for the helper goroutine. If a Write() times out, some of its data
+// may still be written later by the helper. It does not close the
+// given io.Writer. If the writer is nil, nil is returned.
+func NewTimeoutWriter(w io.Writer, idle, total time.Duration,
+	opts ...TimeoutOption) io.WriteCloser {
+	if w == nil {
+		return nil
+	}
+	t := &timeoutIO{w: w, idle: idle, total: total, done: make(chan struct{})}
+	if d, ok := w.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		t.setDeadline = d.SetWriteDeadline
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
@@ -0,0 +1,300 @@
+// Copyright 2014 Joshua Marsh. All rights reserved. Use of this
+// source code is governed by the MIT license that can be found in the
+// LICENSE file.
+
+package wrapio
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTimers is a clock with timers that only moves when told to. It
+// is safe to use from multiple goroutines.
+type fakeTimers struct {
+	mu      sync.Mutex
+	t       time.Time
+	timers  []*fakeTimer
+	created chan struct{} // Gets a value for each new timer.
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeTimers() *fakeTimers {
+	return &fakeTimers{
+		t:       time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC),
+		created: make(chan struct{}, 100),
+	}
+}
+
+func (f *fakeTimers) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.t
+}
+
+func (f *fakeTimers) NewTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ft := &fakeTimer{at: f.t.Add(d), c: make(chan time.Time, 1)}
+	f.timers = append(f.timers, ft)
+	f.created <- struct{}{}
+	return ft.c, func() bool {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		for x, t := range f.timers {
+			if t == ft {
+				f.timers = append(f.timers[:x], f.timers[x+1:]...)
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Advance moves the clock and fires the timers that are due.
+func (f *fakeTimers) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.t = f.t.Add(d)
+	left := f.timers[:0]
+	for _, t := range f.timers {
+		if !t.at.After(f.t) {
+			t.c <- f.t
+		} else {
+			left = append(left, t)
+		}
+	}
+	f.timers = left
+}
+
+// blockReader returns what it's sent on c, one send per Read.
+type blockReader struct {
+	c chan string
+}
+
+func (b *blockReader) Read(p []byte) (int, error) {
+	s, ok := <-b.c
+	if !ok {
+		return 0, io.EOF
+	}
+	return copy(p, s), nil
+}
+
+// fakeTimeout returns a timeout reader running on the given clock.
+func fakeTimeout(f *fakeTimers, r io.Reader, idle, total time.Duration) io.ReadCloser {
+	return NewTimeoutReader(r, idle, total, TimeoutClock(f.Now, f.NewTimer))
+}
+
+// readAsync starts a Read and waits for its timer to be made.
+func readAsync(f *fakeTimers, r io.Reader, p []byte) chan timeoutResult {
+	res := make(chan timeoutResult, 1)
+	go func() {
+		n, err := r.Read(p)
+		res <- timeoutResult{n, err}
+	}()
+	<-f.created
+	return res
+}
+
+func TestTimeoutReaderIdle(t *testing.T) {
+	f := newFakeTimers()
+	br := &blockReader{c: make(chan string)}
+	r := fakeTimeout(f, br, time.Second, 0)
+	p := make([]byte, 10)
+	// Data that arrives in time is returned.
+	res := readAsync(f, r, p)
+	f.Advance(900 * time.Millisecond)
+	br.c <- "hello"
+	if got := <-res; got.n != 5 || got.err != nil || string(p[:5]) != "hello" {
+		t.Errorf("read returned %v %v %q", got.n, got.err, p[:got.n])
+	}
+	// Each Read gets the whole idle time.
+	res = readAsync(f, r, p)
+	f.Advance(999 * time.Millisecond)
+	select {
+	case got := <-res:
+		t.Fatalf("read returned early: %v %v", got.n, got.err)
+	default:
+	}
+	f.Advance(time.Millisecond)
+	got := <-res
+	var te *TimeoutError
+	if got.n != 0 || !errors.Is(got.err, ErrTimeout) || !errors.As(got.err, &te) ||
+		te.Total {
+		t.Errorf("idle read returned %v %v", got.n, got.err)
+	}
+	// The error sticks, and the helper exits once its Read returns.
+	if _, err := r.Read(p); err != got.err {
+		t.Errorf("second read returned %v", err)
+	}
+	br.c <- "late"
+	close(br.c)
+	r.Close()
+	if _, err := r.Read(p); err != ErrClosed {
+		t.Errorf("read after close returned %v", err)
+	}
+}
+
+func TestTimeoutReaderTotal(t *testing.T) {
+	f := newFakeTimers()
+	br := &blockReader{c: make(chan string)}
+	r := fakeTimeout(f, br, time.Second, 2500*time.Millisecond)
+	p := make([]byte, 10)
+	for x := 0; x < 2; x++ {
+		res := readAsync(f, r, p)
+		f.Advance(800 * time.Millisecond)
+		br.c <- "data"
+		if got := <-res; got.n != 4 || got.err != nil {
+			t.Fatalf("read %v returned %v %v", x, got.n, got.err)
+		}
+	}
+	// Only 900ms are left, which is less than the idle time.
+	res := readAsync(f, r, p)
+	f.Advance(900 * time.Millisecond)
+	got := <-res
+	if te, ok := got.err.(*TimeoutError); !ok || !te.Total || !te.Timeout() ||
+		te.Error() != "wrapio: total timeout exceeded" {
+		t.Errorf("total read returned %v %v", got.n, got.err)
+	}
+	close(br.c)
+	r.Close()
+	// Once the time is up, we don't even try.
+	r = fakeTimeout(f, strings.NewReader("data"), 0, time.Second)
+	if n, err := r.Read(p); n != 4 || err != nil {
+		t.Errorf("first read returned %v %v", n, err)
+	}
+	f.Advance(time.Second)
+	if _, err := r.Read(p); !errors.Is(err, ErrTimeout) {
+		t.Errorf("read after total returned %v", err)
+	}
+	r.Close()
+}
+
+func TestTimeoutWriter(t *testing.T) {
+	f := newFakeTimers()
+	pr, pw := io.Pipe()
+	w := NewTimeoutWriter(pw, time.Second, 0, TimeoutClock(f.Now, f.NewTimer))
+	p := []byte("hello")
+	res := make(chan timeoutResult, 1)
+	go func() {
+		n, err := w.Write(p)
+		res <- timeoutResult{n, err}
+	}()
+	<-f.created
+	buf := make([]byte, 5)
+	io.ReadFull(pr, buf)
+	if got := <-res; got.n != 5 || got.err != nil || string(buf) != "hello" {
+		t.Errorf("write returned %v %v %q", got.n, got.err, buf)
+	}
+	go func() {
+		n, err := w.Write(p)
+		res <- timeoutResult{n, err}
+	}()
+	<-f.created
+	f.Advance(time.Second)
+	if got := <-res; got.n != 0 || !errors.Is(got.err, ErrTimeout) {
+		t.Errorf("blocked write returned %v %v", got.n, got.err)
+	}
+	pr.Close()
+	w.Close()
+}
+
+func TestTimeoutDeadline(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	r := NewTimeoutReader(a, 20*time.Millisecond, 0)
+	p := make([]byte, 10)
+	go b.Write([]byte("hi"))
+	if n, err := r.Read(p); n != 2 || err != nil {
+		t.Errorf("read returned %v %v", n, err)
+	}
+	if n, err := r.Read(p); n != 0 || !errors.Is(err, ErrTimeout) {
+		t.Errorf("idle read returned %v %v", n, err)
+	}
+	if r.(*timeoutIO).reqs != nil {
+		t.Errorf("helper was started for a reader with deadlines")
+	}
+	// Closing clears the deadline.
+	r.Close()
+	go b.Write([]byte("ok"))
+	if n, err := a.Read(p); n != 2 || err != nil {
+		t.Errorf("read after close returned %v %v", n, err)
+	}
+	w := NewTimeoutWriter(a, 20*time.Millisecond, 0)
+	if _, err := w.Write(p); !errors.Is(err, ErrTimeout) {
+		t.Errorf("idle write returned %v", err)
+	}
+	w.Close()
+}
+
+func TestTimeoutClose(t *testing.T) {
+	// Close wakes up a Read that is waiting on the helper.
+	f := newFakeTimers()
+	br := &blockReader{c: make(chan string)}
+	r := fakeTimeout(f, br, time.Second, 0)
+	p := make([]byte, 10)
+	res := readAsync(f, r, p)
+	if err := r.Close(); err != nil {
+		t.Errorf("close returned %v", err)
+	}
+	if got := <-res; got.n != 0 || got.err != ErrClosed {
+		t.Errorf("pending read returned %v %v", got.n, got.err)
+	}
+	if _, err := r.Read(p); err != ErrClosed {
+		t.Errorf("read after close returned %v", err)
+	}
+	close(br.c)
+	// It interrupts a Read that is blocked with a deadline, which is
+	// cleared once the Read returns.
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	r = NewTimeoutReader(a, time.Hour, 0)
+	res = make(chan timeoutResult, 1)
+	go func() {
+		n, err := r.Read(p)
+		res <- timeoutResult{n, err}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := r.Close(); err != nil {
+		t.Errorf("close returned %v", err)
+	}
+	if got := <-res; got.n != 0 || got.err != ErrClosed {
+		t.Errorf("blocked read returned %v %v", got.n, got.err)
+	}
+	go b.Write([]byte("ok"))
+	if n, err := a.Read(p); n != 2 || err != nil {
+		t.Errorf("read after close returned %v %v", n, err)
+	}
+}
+
+func TestTimeoutSpecialCases(t *testing.T) {
+	// No timeouts just passes things through.
+	r := NewTimeoutReader(strings.NewReader("data"), 0, 0)
+	p := make([]byte, 10)
+	if n, err := r.Read(p); n != 4 || err != nil || r.(*timeoutIO).reqs != nil {
+		t.Errorf("read returned %v %v", n, err)
+	}
+	if n, err := r.Read(nil); n != 0 || err != nil {
+		t.Errorf("empty read returned %v %v", n, err)
+	}
+	if NewTimeoutReader(nil, time.Second, 0) != nil {
+		t.Errorf("nil io.Reader didn't return nil.")
+	}
+	if NewTimeoutWriter(nil, time.Second, 0) != nil {
+		t.Errorf("nil io.Writer didn't return nil.")
+	}
+	if (&TimeoutError{}).Error() != "wrapio: idle timeout exceeded" {
+		t.Errorf("unexpected idle error message")
+	}
+}
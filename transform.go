@@ -0,0 +1,267 @@
+// Copyright 2014 Joshua Marsh. All rights reserved. Use of this
+// source code is governed by the MIT license that can be found in the
+// LICENSE file.
+
+package wrapio
+
+import (
+	"errors"
+	"io"
+)
+
+var (
+	// ErrShortDst is returned by a TransformFunc when dst is too small
+	// to hold the next piece of output.
+	ErrShortDst = errors.New("wrapio: short destination buffer")
+
+	// ErrShortSrc is returned by a TransformFunc when src doesn't
+	// contain enough data to make progress (e.g. half of an escape
+	// sequence).
+	ErrShortSrc = errors.New("wrapio: short source buffer")
+
+	// errInconsistentByteCount is returned when a TransformFunc
+	// reports success but didn't consume all of src.
+	errInconsistentByteCount = errors.New(
+		"wrapio: transform returned success but consumed fewer bytes than given")
+)
+
+// defaultBufSize is the initial size of the internal buffers. They
+// grow if a TransformFunc can't make progress with them.
+const defaultBufSize = 4096
+
+// TransformFunc writes the transformed version of src to dst. It
+// returns the number of bytes written to dst and the number of bytes
+// consumed from src. Unlike the handlers used by NewFuncReader, the
+// output may be longer or shorter than the input.
+//
+// If dst isn't large enough, ErrShortDst should be returned. If src
+// doesn't contain enough data to produce more output, ErrShortSrc
+// should be returned. In both cases, the transform will be called
+// again with what is left over once there is more room or more
+// data. atEOF is true when src contains the last of the data. Any
+// other error stops the stream.
+type TransformFunc func(dst, src []byte, atEOF bool) (nDst, nSrc int, err error)
+
+// grow returns a buffer twice the size of b with the first n bytes of
+// b copied into it.
+func grow(b []byte, n int) []byte {
+	nb := make([]byte, 2*len(b))
+	copy(nb, b[:n])
+	return nb
+}
+
+// TransformReader implements the io.Reader interface.
+type transformReader struct {
+	t    TransformFunc
+	r    io.Reader
+	err  error // The non-nil error from the last Read() on r.
+	done bool  // Set once everything has been transformed.
+	terr error // The non-nil error from the TransformFunc.
+	dst  []byte
+	dst0 int // The start of the unread output in dst.
+	dst1 int // The end of the unread output in dst.
+	src  []byte
+	src0 int // The start of the untransformed input in src.
+	src1 int // The end of the untransformed input in src.
+}
+
+// Read implements the io.Reader interface.
+func (t *transformReader) Read(p []byte) (int, error) {
+	for {
+		// Send any output we have first.
+		if t.dst0 != t.dst1 {
+			n := copy(p, t.dst[t.dst0:t.dst1])
+			t.dst0 += n
+			if t.dst0 == t.dst1 && t.terr != nil {
+				return n, t.terr
+			}
+			if t.dst0 == t.dst1 && t.done {
+				return n, t.err
+			}
+			return n, nil
+		}
+		if t.terr != nil {
+			return 0, t.terr
+		}
+		if t.done {
+			return 0, t.err
+		}
+		// Transform what we have. We do this even when src is empty at
+		// EOF so the transform can flush anything it's holding onto.
+		if t.src0 != t.src1 || t.err != nil {
+			atEOF := t.err != nil
+			nDst, nSrc, err := t.t(t.dst, t.src[t.src0:t.src1], atEOF)
+			t.dst0, t.dst1 = 0, nDst
+			t.src0 += nSrc
+			switch {
+			case err == nil:
+				if t.src0 != t.src1 {
+					t.terr = errInconsistentByteCount
+				} else if atEOF {
+					t.done = true
+				}
+				// Whenever we have no output, we may need more input.
+				if nDst > 0 || t.terr != nil || t.done {
+					continue
+				}
+			case err == ErrShortDst:
+				if nDst == 0 && nSrc == 0 {
+					t.dst = grow(t.dst, 0)
+				}
+				continue
+			case err == ErrShortSrc:
+				if nDst > 0 {
+					continue
+				}
+				if atEOF {
+					t.terr = io.ErrUnexpectedEOF
+					continue
+				}
+				if nSrc == 0 && t.src0 == 0 && t.src1 == len(t.src) {
+					t.src = grow(t.src, t.src1)
+				}
+			default:
+				t.terr = err
+				continue
+			}
+		}
+		// Move whatever is left to the front and read more.
+		if t.src0 != 0 {
+			t.src1 = copy(t.src, t.src[t.src0:t.src1])
+			t.src0 = 0
+		}
+		n, err := t.r.Read(t.src[t.src1:])
+		t.src1 += n
+		t.err = err
+		if n == 0 && err == nil {
+			// The reader gave us nothing. We'll try again next time.
+			return 0, nil
+		}
+	}
+}
+
+// NewTransformReader returns an io.Reader that runs everything read
+// from the given io.Reader through the given TransformFunc. Output
+// that doesn't fit into the slice given to Read() is held and
+// returned on the next call. If either of the parameters are nil, nil
+// is returned.
+func NewTransformReader(t TransformFunc, r io.Reader) io.Reader {
+	if t == nil || r == nil {
+		return nil
+	}
+	return &transformReader{
+		t:   t,
+		r:   r,
+		dst: make([]byte, defaultBufSize),
+		src: make([]byte, defaultBufSize),
+	}
+}
+
+// TransformWriter implements the io.Closer and io.Writer interface.
+type transformWriter struct {
+	t      TransformFunc
+	w      io.Writer
+	err    error
+	closed bool
+	dst    []byte
+	src    []byte // Input held until the transform can use it.
+}
+
+// transform runs src through the transform and writes out the
+// results. It returns the number of bytes of src that were consumed.
+func (t *transformWriter) transform(src []byte, atEOF bool) (int, error) {
+	consumed := 0
+	for {
+		nDst, nSrc, err := t.t(t.dst, src[consumed:], atEOF)
+		if nDst > 0 {
+			// We can't say how much of the input made it through, so
+			// we count none of it.
+			if _, werr := t.w.Write(t.dst[:nDst]); werr != nil {
+				return consumed, werr
+			}
+		}
+		consumed += nSrc
+		switch {
+		case err == nil:
+			if consumed != len(src) {
+				return consumed, errInconsistentByteCount
+			}
+			return consumed, nil
+		case err == ErrShortDst:
+			if nDst == 0 && nSrc == 0 {
+				t.dst = grow(t.dst, 0)
+			}
+		case err == ErrShortSrc:
+			if nDst == 0 && nSrc == 0 {
+				if atEOF {
+					return consumed, io.ErrUnexpectedEOF
+				}
+				return consumed, nil
+			}
+		default:
+			return consumed, err
+		}
+	}
+}
+
+// Write implements the io.Writer interface.
+func (t *transformWriter) Write(p []byte) (int, error) {
+	if t.closed {
+		return 0, ErrClosed
+	}
+	if t.err != nil {
+		return 0, t.err
+	}
+	// If we are holding some input, p must go after it.
+	src, held := p, len(t.src)
+	if held > 0 {
+		src = append(t.src, p...)
+	}
+	consumed, err := t.transform(src, false)
+	t.src = append(t.src[:0], src[consumed:]...)
+	if err != nil {
+		t.err = err
+		n := consumed - held
+		if n < 0 {
+			n = 0
+		}
+		return n, err
+	}
+	return len(p), nil
+}
+
+// Close implements the io.Closer interface.
+func (t *transformWriter) Close() error {
+	if t.closed || t.err != nil {
+		t.closed = true
+		return t.err
+	}
+	t.closed = true
+	// Let the transform know we are done so it can flush.
+	_, t.err = t.transform(t.src, true)
+	t.src = t.src[:0]
+	return t.err
+}
+
+// NewTransformWriter returns an io.Writer that runs everything
+// written to it through the given TransformFunc before sending it to
+// the given io.Writer. Input the transform can't use yet is held
+// until the next Write(). To adhere to the io.Writer documentation,
+// the returned number of written bytes will always be the length of
+// the given slice unless an error occurred.
+//
+// Because it is impossible to tell when writing is completed, the
+// returned writer is also a closer. The close operation should be
+// called to let the transform flush any remaining data. It does not
+// close the given io.Writer. Calling Close() again returns the same
+// result and Write() after Close() returns ErrClosed.
+func NewTransformWriter(t TransformFunc, w io.Writer) io.WriteCloser {
+	if t == nil || w == nil {
+		return nil
+	}
+	return &transformWriter{
+		t:   t,
+		w:   w,
+		dst: make([]byte, defaultBufSize),
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright 2014 Joshua Marsh. All rights reserved. Use of this
+// source code is governed by the MIT license that can be found in the
+// LICENSE file.
+
+package wrapio
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// hexEncode is a TransformFunc that doubles the size of the data.
+func hexEncode(dst, src []byte, atEOF bool) (int, int, error) {
+	n := len(src)
+	if n > len(dst)/2 {
+		n = len(dst) / 2
+	}
+	hex.Encode(dst, src[:n])
+	if n < len(src) {
+		return 2 * n, n, ErrShortDst
+	}
+	return 2 * n, n, nil
+}
+
+// hexDecode is a TransformFunc that halves the size of the data. It
+// can only work on pairs of bytes.
+func hexDecode(dst, src []byte, atEOF bool) (int, int, error) {
+	n := len(src) / 2
+	if n > len(dst) {
+		n = len(dst)
+	}
+	if _, err := hex.Decode(dst, src[:2*n]); err != nil {
+		return 0, 0, err
+	}
+	switch {
+	case 2*n == len(src):
+		return n, 2 * n, nil
+	case n == len(dst):
+		return n, 2 * n, ErrShortDst
+	}
+	return n, 2 * n, ErrShortSrc
+}
+
+// bigDst is a TransformFunc that needs more than the default buffer
+// size to write anything.
+func bigDst(dst, src []byte, atEOF bool) (int, int, error) {
+	need := len(src) * (defaultBufSize + 1)
+	if len(dst) < need {
+		return 0, 0, ErrShortDst
+	}
+	for x := 0; x < need; x++ {
+		dst[x] = '.'
+	}
+	return need, len(src), nil
+}
+
+func ExampleNewTransformReader() {
+	r := NewTransformReader(hexEncode, strings.NewReader("wrapio"))
+	b, err := ioutil.ReadAll(r)
+	fmt.Println(string(b), err)
+	// Output:
+	// 77726170696f <nil>
+}
+
+func TestTransformReader(t *testing.T) {
+	data := strings.Repeat("I eat pizza for breakfast. ", 500)
+	tests := []struct {
+		t        TransformFunc
+		r        io.Reader
+		p        int
+		expected string
+	}{
+		{
+			t:        hexEncode,
+			r:        strings.NewReader(data),
+			p:        512,
+			expected: hex.EncodeToString([]byte(data)),
+		},
+		{
+			t:        hexEncode,
+			r:        iotest.OneByteReader(strings.NewReader(data)),
+			p:        3,
+			expected: hex.EncodeToString([]byte(data)),
+		},
+		{
+			t:        hexDecode,
+			r:        iotest.OneByteReader(strings.NewReader(hex.EncodeToString([]byte(data)))),
+			p:        7,
+			expected: data,
+		},
+		{
+			t:        hexDecode,
+			r:        iotest.HalfReader(strings.NewReader(hex.EncodeToString([]byte(data)))),
+			p:        100000,
+			expected: data,
+		},
+		{
+			t:        bigDst,
+			r:        strings.NewReader("ab"),
+			p:        1000,
+			expected: strings.Repeat(".", 2*(defaultBufSize+1)),
+		},
+	}
+	for k, test := range tests {
+		r := NewTransformReader(test.t, test.r)
+		buf := &bytes.Buffer{}
+		p := make([]byte, test.p)
+		for {
+			n, err := r.Read(p)
+			buf.Write(p[:n])
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Test %v: unexpected error: %v", k, err)
+			}
+		}
+		if buf.String() != test.expected {
+			t.Errorf("Test %v: unexpected output (%v bytes), expected %v bytes",
+				k, buf.Len(), len(test.expected))
+		}
+	}
+	// A trailing half of a pair is an error.
+	r := NewTransformReader(hexDecode, strings.NewReader("6f6"))
+	if _, err := ioutil.ReadAll(r); err != io.ErrUnexpectedEOF {
+		t.Errorf("short source at EOF: err (%v) != expected (%v)",
+			err, io.ErrUnexpectedEOF)
+	}
+	// Invalid data is passed along.
+	r = NewTransformReader(hexDecode, strings.NewReader("zz"))
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Errorf("invalid data didn't return an error")
+	}
+	// A reader that gives us nothing doesn't keep us spinning while we
+	// wait for the rest of a pair.
+	r = NewTransformReader(hexDecode, io.MultiReader(strings.NewReader("6"), er{}))
+	for x := 0; x < 2; x++ {
+		if n, err := r.Read(make([]byte, 10)); n != 0 || err != nil {
+			t.Errorf("Read %v: got (%v, %v), expected (0, <nil>)", x, n, err)
+		}
+	}
+	// Test the special error cases.
+	if NewTransformReader(hexEncode, nil) != nil {
+		t.Errorf("nil io.Reader didn't return nil.")
+	}
+	if NewTransformReader(nil, strings.NewReader("")) != nil {
+		t.Errorf("nil func didn't return nil.")
+	}
+}
+
+func TestTransformReaderChain(t *testing.T) {
+	// Expand the data, send it out in blocks and then pad the last
+	// block.
+	tr := NewTransformReader(hexEncode, strings.NewReader("0123456789"))
+	br := NewBlockReader(8, tr)
+	lr := NewLastFuncReader(func(p []byte) []byte {
+		for len(p)%8 != 0 {
+			p = append(p, '-')
+		}
+		return p
+	}, br)
+	buf := &bytes.Buffer{}
+	p := make([]byte, 8)
+	for {
+		n, err := lr.Read(p)
+		buf.Write(p[:n])
+		if err != nil {
+			break
+		}
+	}
+	expected := hex.EncodeToString([]byte("0123456789")) + "----"
+	if buf.String() != expected {
+		t.Errorf("chain output '%v' != expected '%v'", buf.String(), expected)
+	}
+}
+
+func TestTransformWriter(t *testing.T) {
+	data := strings.Repeat("I eat pizza for breakfast. ", 500)
+	encoded := hex.EncodeToString([]byte(data))
+	tests := []struct {
+		t        TransformFunc
+		writes   []string
+		expected string
+	}{
+		{
+			t:        hexEncode,
+			writes:   []string{data[:1], data[1:5000], data[5000:]},
+			expected: encoded,
+		},
+		{
+			t:        hexDecode,
+			writes:   []string{encoded[:1], encoded[1:4], encoded[4:9999], encoded[9999:]},
+			expected: data,
+		},
+		{
+			t:        bigDst,
+			writes:   []string{"a", "b"},
+			expected: strings.Repeat(".", 2*(defaultBufSize+1)),
+		},
+	}
+	for k, test := range tests {
+		buf := &bytes.Buffer{}
+		w := NewTransformWriter(test.t, buf)
+		for x, write := range test.writes {
+			n, err := w.Write([]byte(write))
+			if n != len(write) || err != nil {
+				t.Errorf("Test %v(%v): got (%v, %v), expected (%v, %v)",
+					k, x, n, err, len(write), nil)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Errorf("Test %v: unexpected close error: %v", k, err)
+		}
+		if buf.String() != test.expected {
+			t.Errorf("Test %v: unexpected output (%v bytes), expected %v bytes",
+				k, buf.Len(), len(test.expected))
+		}
+	}
+	// A trailing half of a pair is an error on close.
+	w := NewTransformWriter(hexDecode, ioutil.Discard)
+	w.Write([]byte("6f6"))
+	if err := w.Close(); err != io.ErrUnexpectedEOF {
+		t.Errorf("short source at close: err (%v) != expected (%v)",
+			err, io.ErrUnexpectedEOF)
+	}
+	// Errors from the underlying writer are passed along.
+	e := ew{err: fmt.Errorf("i did it")}
+	w = NewTransformWriter(hexEncode, e)
+	for x := 0; x < 2; x++ {
+		if n, err := w.Write([]byte("test")); n != 0 || err != e.err {
+			t.Errorf("Test %v: bad error writer results: %v %v", x, n, err)
+		}
+	}
+	// It should work as the writer under a block writer.
+	buf := &bytes.Buffer{}
+	tw := NewTransformWriter(hexEncode, buf)
+	bw := NewBlockWriter(4, tw)
+	bw.Write([]byte("012345"))
+	bw.Close()
+	tw.Close()
+	if buf.String() != hex.EncodeToString([]byte("012345")) {
+		t.Errorf("block chain output '%v' unexpected", buf.String())
+	}
+	// The trailer is only written once and nothing gets through after
+	// Close().
+	buf.Reset()
+	tw = NewTransformWriter(func(dst, src []byte, atEOF bool) (int, int, error) {
+		n := copy(dst, src)
+		if atEOF {
+			n += copy(dst[n:], "$")
+		}
+		return n, len(src), nil
+	}, buf)
+	tw.Write([]byte("abc"))
+	for x := 0; x < 2; x++ {
+		if err := tw.Close(); err != nil {
+			t.Errorf("Close %v: unexpected error: %v", x, err)
+		}
+	}
+	if n, err := tw.Write([]byte("x")); n != 0 || err != ErrClosed {
+		t.Errorf("write after close: got (%v, %v), expected (0, %v)",
+			n, err, ErrClosed)
+	}
+	if buf.String() != "abc$" {
+		t.Errorf("closed output '%v' != expected 'abc$'", buf.String())
+	}
+	// Test the special error cases.
+	if NewTransformWriter(hexEncode, nil) != nil {
+		t.Errorf("nil io.Writer didn't return nil.")
+	}
+	if NewTransformWriter(nil, ioutil.Discard) != nil {
+		t.Errorf("nil func didn't return nil.")
+	}
+}
@@ -12,39 +12,74 @@
 package wrapio
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"hash"
 	"io"
-	"sync"
 )
 
 // Wrap implements the io.Closer, io.Reader, and io.Writer interface.
 type wrap struct {
-	handler func([]byte)
+	handler func([]byte) error
 	r       io.Reader
 	w       io.Writer
+	err     error // The non-nil error from the last handler call.
 }
 
 // Read implements the io.Reader interface.
 func (w *wrap) Read(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
 	n, err := w.r.Read(p)
 	if n > 0 {
-		w.handler(p[:n])
+		if herr := w.handler(p[:n]); herr != nil {
+			w.err = herr
+			return n, herr
+		}
 	}
 	return n, err
 }
 
 // Write implements the io.Writer interface.
 func (w *wrap) Write(p []byte) (int, error) {
-	w.handler(p)
+	if w.err != nil {
+		return 0, w.err
+	}
+	if err := w.handler(p); err != nil {
+		w.err = err
+		return 0, err
+	}
 	return w.w.Write(p)
 }
 
+// ignoreErr turns a handler that can't fail into one that can.
+func ignoreErr(handler func([]byte)) func([]byte) error {
+	return func(p []byte) error {
+		handler(p)
+		return nil
+	}
+}
+
 // NewFuncReader returns an io.Reader that wraps the given io.Reader
 // with the given handler. Any Read() operations that read at least
 // one byte will run through the handler before being returned. If
 // either of the parameters are nil, nil is returned.
 func NewFuncReader(handler func([]byte), r io.Reader) io.Reader {
+	if handler == nil {
+		return nil
+	}
+	return NewFuncReaderE(ignoreErr(handler), r)
+}
+
+// NewFuncReaderE is like NewFuncReader except that the handler can
+// stop the stream by returning an error. The bytes given to the
+// handler are still returned from that Read() along with the
+// handler's error. Every Read() after that returns 0 and the same
+// error without touching the underlying reader. If either of the
+// parameters are nil, nil is returned.
+func NewFuncReaderE(handler func([]byte) error, r io.Reader) io.Reader {
 	if handler == nil || r == nil {
 		return nil
 	}
@@ -62,6 +97,19 @@ func NewFuncReader(handler func([]byte), r io.Reader) io.Reader {
 // is a special case because most errors on write are fatal, but in
 // cases where writing will continue, this must be taken into account.
 func NewFuncWriter(handler func([]byte), w io.Writer) io.Writer {
+	if handler == nil {
+		return nil
+	}
+	return NewFuncWriterE(ignoreErr(handler), w)
+}
+
+// NewFuncWriterE is like NewFuncWriter except that the handler can
+// stop the stream by returning an error. When it does, none of the
+// data from that Write() reaches the underlying writer and 0 is
+// returned along with the handler's error. Every Write() after that
+// returns the same error. If either of the parameters are nil, nil is
+// returned.
+func NewFuncWriterE(handler func([]byte) error, w io.Writer) io.Writer {
 	if handler == nil || w == nil {
 		return nil
 	}
@@ -96,56 +144,85 @@ func NewHashWriter(h hash.Hash, w io.Writer) io.Writer {
 	}, w)
 }
 
-// Stats maintains the statistics about the I/O. It is updated with
-// each read/write operation. If you are accessing the values, you
-// should Lock() before accessing them and Unlock() after you are done
-// to prevent possible race conditions.
-type Stats struct {
-	sync.Mutex
-	Total   int     // The total number of bytes that have passed through.
-	Average float64 // The average number of bytes read or written per call.
-	Calls   int     // The number of calls made to Read or Write.
+// DigestMismatchError is returned by the reader from
+// NewVerifyingHashReader when the data that was read doesn't match
+// the expected digest.
+type DigestMismatchError struct {
+	Expected []byte // The digest we were told to expect.
+	Actual   []byte // The digest of the data that was read.
 }
 
-// String implements the fmt.Stringer interface.
-func (s Stats) String() string {
-	return fmt.Sprintf("[Total: %d, Average: %f, Calls: %d]",
-		s.Total, s.Average, s.Calls)
+// Error implements the error interface.
+func (e *DigestMismatchError) Error() string {
+	return fmt.Sprintf("wrapio: digest mismatch: expected %x, got %x",
+		e.Expected, e.Actual)
 }
 
-func (s *Stats) update(p []byte) {
-	s.Lock()
-	defer s.Unlock()
-	s.Total += len(p)
-	s.Calls++
-	s.Average = float64(s.Total / s.Calls)
+// Verify implements the io.Reader interface.
+type verify struct {
+	h        hash.Hash
+	expected []byte
+	r        io.Reader
 }
 
-// NewStatsReader returns an io.Reader that wraps the given io.Reader
-// with the returned statistical analyzer. Any Read() operations will
-// be analyzed and the statistics updated. If either of the parameters
-// are nil, nil is returned.
-func NewStatsReader(r io.Reader) (*Stats, io.Reader) {
-	s := &Stats{}
-	return s, NewFuncReader(s.update, r)
+// Read implements the io.Reader interface.
+func (v *verify) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	if err == io.EOF {
+		if actual := v.h.Sum(nil); !bytes.Equal(actual, v.expected) {
+			return n, &DigestMismatchError{Expected: v.expected, Actual: actual}
+		}
+	}
+	return n, err
 }
 
-// NewStatsWriter returns an io.Writer that wraps the given io.Writer
-// with the returned statistical analyzer. Any Write() operations will
-// be analyzed and the statistics updated. If either of the parameters
-// are nil, nil is returned.
-func NewStatsWriter(w io.Writer) (*Stats, io.Writer) {
-	s := &Stats{}
-	return s, NewFuncWriter(s.update, w)
+// NewVerifyingHashReader returns an io.Reader that works like
+// NewHashReader but also compares the hash against the expected
+// digest once the given io.Reader returns io.EOF. If they differ, the
+// io.EOF is replaced with a *DigestMismatchError, so things like
+// io.Copy fail instead of quietly succeeding on corrupt data. Data is
+// still returned as it is read, so it shouldn't be trusted until EOF
+// is reached. If any of the parameters are nil, nil is returned.
+func NewVerifyingHashReader(h hash.Hash, expected []byte,
+	r io.Reader) io.Reader {
+	if h == nil || expected == nil || r == nil {
+		return nil
+	}
+	return &verify{h: h, expected: expected, r: NewHashReader(h, r)}
 }
 
+// ErrPartialBlock is returned when data that has to be made of whole
+// blocks isn't.
+var ErrPartialBlock = errors.New("wrapio: partial block")
+
+// ErrClosed is returned when a reader or writer is used after it has
+// been closed.
+var ErrClosed = errors.New("wrapio: use of closed reader or writer")
+
 type block struct {
-	r    io.Reader
-	w    io.Writer
-	size int
-	buf  []byte
-	err  error // The non-nil error from the last Read().
+	r     io.Reader
+	w     io.Writer
+	size  int
+	buf   []byte
+	err   error  // The non-nil error from the last Read().
+	rem   int    // The bytes left of a block we've partially sent.
+	stage []byte // Aligned scratch space for Read(), ReadFrom() and Write().
 
+	tail     func([]byte) error // Handles the partial block on Close().
+	closeW   bool               // Close w too.
+	through  bool               // Pass whole blocks along without copying them.
+	closed   bool
+	closeErr error // What the first Close() returned.
+}
+
+// blockCopySize is roughly how much ReadFrom() reads and Write()
+// copies at once. It's rounded down to a multiple of the block size.
+const blockCopySize = 32 * 1024
+
+// consume drops the first n bytes from the buffer.
+func (b *block) consume(n int) {
+	copy(b.buf, b.buf[n:])
+	b.buf = b.buf[:len(b.buf)-n]
 }
 
 // Read implements the io.Reader interface.
@@ -154,16 +231,28 @@ func (b *block) Read(p []byte) (int, error) {
 	if b.err != nil && len(b.buf) == 0 {
 		return 0, b.err
 	}
+	// Finish sending a block we've started on before anything else so
+	// we stay aligned.
+	if b.rem > 0 {
+		n := copy(p, b.buf[:b.rem])
+		b.rem -= n
+		b.consume(n)
+		return n, nil
+	}
 	// We'll only fill p with full blocks.
 	n := (len(p) / b.size) * b.size
 	if n == 0 {
-		return 0, nil
+		return b.readPartial(p)
 	}
-	if b.err == nil {
-		// Fill p temporarily and append it to our buffer.
-		l, err := b.r.Read(p)
+	// Fill p temporarily and append it to our buffer until we have a
+	// block to send. We only give the reader whole blocks to fill.
+	for b.err == nil && len(b.buf) < b.size {
+		l, err := b.r.Read(p[:n])
 		b.err = err
 		b.buf = append(b.buf, p[:l]...)
+		if l == 0 {
+			break
+		}
 	}
 	// If the size of p if bigger than what we have, only pull the
 	// number of blocks that is in the buffer.
@@ -177,56 +266,242 @@ func (b *block) Read(p []byte) (int, error) {
 	}
 	// Copy what we have to p.
 	copy(p, b.buf[:n])
-	copy(b.buf, b.buf[n:])
-	b.buf = b.buf[:len(b.buf)-n]
+	b.consume(n)
+	return n, nil
+}
+
+// readPartial handles a p that is too small to hold a block. We read
+// a whole block into our buffer and send as much of it as fits. The
+// rest goes out on the following calls.
+func (b *block) readPartial(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if b.stage == nil {
+		b.stage = make([]byte, b.size)
+	}
+	for b.err == nil && len(b.buf) < b.size {
+		l, err := b.r.Read(b.stage)
+		b.err = err
+		b.buf = append(b.buf, b.stage[:l]...)
+		if l == 0 {
+			break
+		}
+	}
+	blk := len(b.buf)
+	if blk > b.size {
+		blk = b.size
+	}
+	if blk < b.size && b.err == nil {
+		// The reader gave us nothing. We'll try again next time.
+		return 0, nil
+	}
+	if blk == 0 {
+		return 0, b.err
+	}
+	n := copy(p, b.buf[:blk])
+	b.rem = blk - n
+	b.consume(n)
 	return n, nil
 }
 
 // Write implements the io.Writer interface.
 func (b *block) Write(p []byte) (int, error) {
+	if b.closed {
+		return 0, ErrClosed
+	}
 	if b.err != nil {
 		return 0, b.err
 	}
-	// We should first append p to our buffer.
-	b.buf = append(b.buf, p...)
-	// Write out any whole blocks.
-	l := (len(b.buf) / b.size) * b.size
-	if l > 0 {
-		n, err := b.w.Write(b.buf[:l])
-		// Move the unwritten portion to the beginning of the buffer and
-		// reslice the buffer.
-		copy(b.buf, b.buf[l:])
-		b.buf = b.buf[:len(b.buf)-l]
-		// In the error case, we want to report the actual written
-		// information.
+	n := 0
+	// Top up the partial block we're holding first.
+	if len(b.buf) > 0 {
+		held := len(b.buf)
+		n = copy(b.buf[held:b.size], p)
+		b.buf = b.buf[:held+n]
+		if len(b.buf) < b.size {
+			return len(p), nil
+		}
+		if wn, err := b.w.Write(b.buf); err != nil {
+			// Only report the bytes from p that made it.
+			b.err = err
+			if wn -= held; wn < 0 {
+				wn = 0
+			}
+			return wn, err
+		}
+		b.buf = b.buf[:0]
+	}
+	// Whole blocks go straight through if we're allowed to. Otherwise
+	// they are copied, so the writer below can't change p.
+	for l := ((len(p) - n) / b.size) * b.size; l > 0; {
+		chunk := p[n : n+l]
+		if !b.through {
+			stage := b.stageBuf()
+			chunk = stage[:copy(stage, chunk)]
+		}
+		wn, err := b.w.Write(chunk)
 		if err != nil {
 			b.err = err
-			return n, err
+			return n + wn, err
 		}
+		n += len(chunk)
+		l -= len(chunk)
 	}
+	// Hold on to what is left. It's less than a block, so it fits.
+	b.buf = append(b.buf, p[n:]...)
 	return len(p), nil
 }
 
+// stageBuf returns the block aligned buffer used to copy whole blocks,
+// making it if needed.
+func (b *block) stageBuf() []byte {
+	if b.stage == nil {
+		l := (blockCopySize / b.size) * b.size
+		if l == 0 {
+			l = b.size
+		}
+		b.stage = make([]byte, l)
+	}
+	return b.stage
+}
+
+// ReadFrom implements the io.ReaderFrom interface. The data is read
+// into a block aligned buffer, so the whole blocks can be written
+// without being copied anywhere else.
+func (b *block) ReadFrom(r io.Reader) (int64, error) {
+	if b.closed {
+		return 0, ErrClosed
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	b.stageBuf()
+	// Start with the partial block we're holding.
+	have := copy(b.stage, b.buf)
+	b.buf = b.buf[:0]
+	var total int64
+	for {
+		l, err := r.Read(b.stage[have:])
+		total += int64(l)
+		have += l
+		if n := (have / b.size) * b.size; n > 0 {
+			if _, werr := b.w.Write(b.stage[:n]); werr != nil {
+				b.err = werr
+				return total, werr
+			}
+			have = copy(b.stage, b.stage[n:have])
+		}
+		if err != nil {
+			// Hold on to the partial block for the next Write() or
+			// Close().
+			b.buf = append(b.buf, b.stage[:have]...)
+			if err == io.EOF {
+				err = nil
+			}
+			return total, err
+		}
+	}
+}
+
 // Close implements the io.Closer interface.
 func (b *block) Close() error {
-	if b.err != nil {
-		return b.err
+	if b.closed {
+		return b.closeErr
 	}
-	// Write out any remaining data (which wouldn't have fit into a
-	// block).
-	if len(b.buf) > 0 {
-		_, err := b.w.Write(b.buf)
-		return err
+	b.closed = true
+	err := b.err
+	if err == nil {
+		// Handle any remaining data (which wouldn't have fit into a
+		// block).
+		if b.tail != nil {
+			err = b.tail(b.buf)
+		} else if len(b.buf) > 0 {
+			_, err = b.w.Write(b.buf)
+		}
+		b.buf = b.buf[:0]
+	}
+	if c, ok := b.w.(io.Closer); ok && b.closeW {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	b.closeErr = err
+	return err
+}
+
+// BlockWriterOption changes how the writer returned by NewBlockWriter
+// behaves.
+type BlockWriterOption func(*block)
+
+// BlockPadTail pads the data left over on Close() with the given
+// Padding before writing it. The padding is written even if nothing is
+// left over, so schemes like PKCS7 work as expected.
+func BlockPadTail(pad Padding) BlockWriterOption {
+	return func(b *block) {
+		b.tail = func(p []byte) error {
+			p = pad.Pad(p, b.size)
+			if len(p) == 0 {
+				return nil
+			}
+			_, err := b.w.Write(p)
+			return err
+		}
+	}
+}
+
+// BlockRejectPartial makes Close() return ErrPartialBlock instead of
+// writing a partial block. The partial block is dropped.
+func BlockRejectPartial() BlockWriterOption {
+	return func(b *block) {
+		b.tail = func(p []byte) error {
+			if len(p) > 0 {
+				return ErrPartialBlock
+			}
+			return nil
+		}
+	}
+}
+
+// BlockTailFunc hands the data left over on Close() to f instead of
+// writing it. It is called even if nothing is left over. The slice is
+// only valid during the call. Any error it returns is returned from
+// Close().
+func BlockTailFunc(f func(tail []byte) error) BlockWriterOption {
+	return func(b *block) {
+		b.tail = f
 	}
-	return nil
 }
 
-// NewBlockReader returns a reader that sends data to the given reader
-// in blocks that are a multiple of size. The one exception of this is
-// the last Read() in which there may be an incomplete block. If p in
-// Read(p) is not the length of a block, no data will be written to it
-// (i.e it will return 0, nil). This may cause an infinite loop if you
-// never give a slice larger than size.
+// BlockPassThrough passes whole blocks from the slice given to Write()
+// straight to the given writer instead of copying them first. The
+// given writer must not change the slice it gets, since it's the
+// caller's.
+func BlockPassThrough() BlockWriterOption {
+	return func(b *block) {
+		b.through = true
+	}
+}
+
+// BlockCloseWriter makes Close() also close the given writer if it
+// implements io.Closer.
+func BlockCloseWriter() BlockWriterOption {
+	return func(b *block) {
+		b.closeW = true
+	}
+}
+
+// NewBlockReader returns a reader that sends data from the given
+// reader in blocks that are a multiple of size. The one exception of
+// this is the last Read() in which there may be an incomplete block.
+// The given reader is only ever asked to fill slices that are a
+// multiple of size, so handlers wrapped below it see whole blocks.
+//
+// If p in Read(p) is smaller than a block, a whole block is read and
+// held and then handed out across as many calls as it takes. Once it
+// has all been sent, reads go back to whole blocks. This means any
+// buffer size works, but callers that need whole blocks should give a
+// slice at least size long.
 func NewBlockReader(size int, r io.Reader) io.Reader {
 	if r == nil || size < 1 {
 		return nil
@@ -241,125 +516,221 @@ func NewBlockReader(size int, r io.Reader) io.Reader {
 // bytes will always be the length of the given slice unless an error
 // occurred in writing.
 //
+// Whole blocks in the given slice are copied into a block aligned
+// buffer of about 32KB and passed along from there, so the given
+// writer can change what it gets. BlockPassThrough passes them as
+// they are instead. At most one partial block is held. The returned
+// writer also implements io.ReaderFrom, so io.Copy() reads straight
+// into a block aligned buffer.
+//
 // Because it is impossible to tell when writing is completed, the
 // returned writer is also a closer. The close operation should be
 // called to flush out the remaining unwritten data that did not fit
-// into a block size.
-func NewBlockWriter(size int, w io.Writer) io.WriteCloser {
+// into a block size. By default it is written as is and the given
+// writer isn't closed. The options change that. If more than one of
+// BlockPadTail, BlockRejectPartial and BlockTailFunc is given, the
+// last one wins. Calling Close() again returns the same result and
+// Write() after Close() returns ErrClosed.
+func NewBlockWriter(size int, w io.Writer,
+	opts ...BlockWriterOption) io.WriteCloser {
 	if w == nil || size < 1 {
 		return nil
 	}
-	return &block{w: w, size: size}
+	b := &block{w: w, size: size, buf: make([]byte, 0, size)}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
 }
 
 // Last implements the io.Closer, io.Reader, and io.Writer interface.
 type last struct {
-	handler func([]byte) []byte
-	bufLen  int
-	bufCap  int
-	tmpCap  int
-	tmpLen  int
-	buf     []byte
-	tmp     []byte
+	handler func([]byte) ([]byte, error)
+	held    []byte // The latest chunk, which may be the last one.
+	out     []byte // Data waiting to be returned from Read().
+	outBuf  []byte // The buffer behind out if it's one of ours.
+	spare   []byte // A buffer that isn't in use.
 	err     error
 	r       io.Reader
 	w       io.Writer
+
+	closeW  bool // Close w too.
+	onEmpty bool // Run the handler even if nothing was written.
+	hold    int  // The most of each Write() to hold, or all of it if 0.
+	closed  bool
 }
 
 // Read implements the io.Reader interface.
 func (l *last) Read(p []byte) (int, error) {
-	lp := len(p)
-	// Check our error scenarios first.
-	if l.err != nil && l.bufLen == 0 {
-		// We've sent all of our buffer and have an error condition. We
-		// are done.
-		return 0, l.err
-	} else if l.err != nil {
-		// We have an error condition, but haven't sent all of our data.
-		data := l.handler(l.buf[:l.bufLen])
-		copy(p, data)
-		n := lp
-		if n > len(data) {
-			n = len(data)
+	for len(l.out) == 0 {
+		if l.err != nil {
+			if l.held == nil {
+				// We've sent everything. We are done.
+				return 0, l.err
+			}
+			// The chunk we are holding is the last one.
+			data, err := l.handler(l.held)
+			l.held = nil
+			if err != nil && l.err == io.EOF {
+				// The handler's error replaces the EOF and the data.
+				l.err = err
+				return 0, err
+			}
+			l.out, l.outBuf = data, nil
+			continue
 		}
-		l.bufLen = 0
-		return n, l.err
-	}
-	// On the first call, we'll have an empty buffer. Let's fill it.
-	if l.buf == nil {
-		l.buf = make([]byte, lp)
-		l.bufCap = lp
-		l.bufLen, l.err = l.r.Read(l.buf)
-		if l.tmpLen == 0 || l.err != nil {
-			// Our first read could be our last.
-			return l.Read(p)
+		if len(p) == 0 {
+			return 0, nil
 		}
+		// Read the next chunk. The one we're holding isn't the last,
+		// so it can be sent.
+		buf := l.spare
+		if cap(buf) < len(p) {
+			buf = make([]byte, len(p))
+		}
+		n, err := l.r.Read(buf[:len(p)])
+		l.err = err
+		if n > 0 {
+			free := l.outBuf
+			l.out, l.outBuf = l.held, l.held
+			l.held = buf[:n]
+			l.spare = free
+		} else if err == nil {
+			// The reader gave us nothing. We'll try again next time.
+			return 0, nil
+		}
+	}
+	n := copy(p, l.out)
+	l.out = l.out[n:]
+	if len(l.out) == 0 && l.held == nil && l.err != nil {
+		return n, l.err
 	}
-	// We should do a read at this point. If the read returns data, we
-	// want to fill p, and copy the data to our buffer. If it doesn't
-	// return data and an error, then we know our last read was it so we
-	// should close out.
-	if l.tmpCap < lp {
-		l.tmp = make([]byte, lp)
-		l.tmpCap = lp
-	}
-	l.tmpLen, l.err = l.r.Read(l.tmp)
-	if l.tmpLen == 0 {
-		return l.Read(p)
-	}
-	// Copy as much of our buffer as we can into p.
-	n := lp
-	if n > l.bufLen {
-		n = l.bufLen
-	}
-	copy(p, l.buf[:n])
-	// Resize our buffer if necessary and copy our temporary data to the
-	// buffer.
-	if l.bufCap < l.tmpCap {
-		l.buf = make([]byte, l.tmpCap)
-		l.bufCap = l.tmpCap
-	}
-	copy(l.buf, l.tmp[:l.tmpLen])
-	l.bufLen = l.tmpLen
 	return n, nil
 }
 
 // Write implements the io.Writer interface.
 func (l *last) Write(p []byte) (int, error) {
+	if l.closed {
+		return 0, ErrClosed
+	}
 	if l.err != nil {
 		return 0, l.err
 	}
-	// Write out the current buffer if we have some.
-	if l.bufLen > 0 {
-		_, l.err = l.w.Write(l.buf[:l.bufLen])
+	if len(p) == 0 {
+		// Don't let an empty write take the place of the last one.
+		return 0, nil
 	}
-	// Resize the buffer if necessary.
-	lp := len(p)
-	if l.bufCap < lp {
-		l.buf = make([]byte, lp)
-		l.bufCap = lp
+	// Write out the current buffer if we have some. If that fails, p
+	// wasn't taken.
+	if len(l.held) > 0 {
+		if _, err := l.w.Write(l.held); err != nil {
+			l.err = err
+			return 0, err
+		}
+		l.held = l.held[:0]
+	}
+	// Anything before the part we hold can't be last, so it goes
+	// straight through.
+	if l.hold > 0 && len(p) > l.hold {
+		n := len(p) - l.hold
+		if wn, err := l.w.Write(p[:n]); err != nil {
+			l.err = err
+			return wn, err
+		}
+		l.held = append(l.held, p[n:]...)
+		return len(p), nil
 	}
 	// Copy p into our buffer.
-	copy(l.buf, p)
-	l.bufLen = lp
-	return lp, nil
+	l.held = append(l.held, p...)
+	return len(p), nil
 }
 
 // Close implements the io.Closer interface.
 func (l *last) Close() error {
-	if l.bufLen > 0 {
-		_, l.err = l.w.Write(l.handler(l.buf[:l.bufLen]))
+	if l.closed {
+		return l.err
+	}
+	l.closed = true
+	if l.err == nil && (len(l.held) > 0 || l.onEmpty) {
+		data, err := l.handler(l.held)
+		if err == nil {
+			_, err = l.w.Write(data)
+		}
+		l.err = err
+	}
+	if c, ok := l.w.(io.Closer); ok && l.closeW {
+		if err := c.Close(); l.err == nil {
+			l.err = err
+		}
 	}
 	return l.err
 }
 
+// LastWriterOption changes how the writer returned by
+// NewLastFuncWriter or NewLastFuncWriterE behaves.
+type LastWriterOption func(*last)
+
+// LastCloseWriter makes Close() also close the given writer if it
+// implements io.Closer.
+func LastCloseWriter() LastWriterOption {
+	return func(l *last) {
+		l.closeW = true
+	}
+}
+
+// LastHoldBack makes Write() hold on to at most the last n bytes of
+// each Write() instead of all of it. The rest is sent from the given
+// slice right away, so the handler only ever gets those last n bytes.
+// It's useful when the writer below takes fixed size chunks, so large
+// writes don't have to be copied. Values less than 1 are ignored.
+func LastHoldBack(n int) LastWriterOption {
+	return func(l *last) {
+		if n > 0 {
+			l.hold = n
+		}
+	}
+}
+
+// LastRunOnEmpty makes Close() call the handler with an empty slice
+// if nothing was written, so it can still add something like a
+// trailer.
+func LastRunOnEmpty() LastWriterOption {
+	return func(l *last) {
+		l.onEmpty = true
+	}
+}
+
+// ignoreLastErr turns a last handler that can't fail into one that
+// can.
+func ignoreLastErr(handler func([]byte) []byte) func([]byte) ([]byte, error) {
+	return func(p []byte) ([]byte, error) {
+		return handler(p), nil
+	}
+}
+
 // NewLastFuncReader returns an io.Reader that calls the given handler
-// on the last Read() operation before passing it along. The last
-// Read() operation is either the data returned with an error or if
-// there is no data returned with the error, the data returned from
-// the last call. If the slice passed to Read() is not consistent,
-// data may be truncated.
+// on the last chunk of data before passing it along. The last chunk is
+// either the data the given reader returned with an error or if there
+// is no data returned with the error, the data returned from the call
+// before it. Each chunk is read with a slice the size of the one given
+// to Read(), so the size of the last chunk depends on it. Chunks are
+// queued, so no data is lost when those sizes vary, and if the handler
+// returns more than fits in p, the rest is returned on the following
+// calls.
 func NewLastFuncReader(handler func([]byte) []byte, r io.Reader) io.Reader {
+	if handler == nil {
+		return nil
+	}
+	return NewLastFuncReaderE(ignoreLastErr(handler), r)
+}
+
+// NewLastFuncReaderE is like NewLastFuncReader except that the
+// handler can fail. If it returns an error when the stream ended with
+// io.EOF, the error is returned in place of the io.EOF and the data.
+// If the stream ended with some other error, that error is returned
+// instead. If either of the parameters are nil, nil is returned.
+func NewLastFuncReaderE(handler func([]byte) ([]byte, error),
+	r io.Reader) io.Reader {
 	if handler == nil || r == nil {
 		return nil
 	}
@@ -369,15 +740,38 @@ func NewLastFuncReader(handler func([]byte) []byte, r io.Reader) io.Reader {
 // NewLastFuncWriter returns an io.Writer that uses the given handler
 // on the data from the very last Write() operation. It does this by
 // holding onto the last Write()'s data without sending it. The first
-// call to Write() won't send data to the given writer. Because it is
-// impossible to tell when the last write is, the Close() function
-// should be called after all the Write()s have been completed. This
-// will cause the last write to be handed to the handler. The returned
-// byte slice will be sent along.
-func NewLastFuncWriter(handler func([]byte) []byte,
-	w io.Writer) io.WriteCloser {
+// call to Write() won't send data to the given writer, and empty
+// writes are ignored. If sending the held data fails, the error is
+// returned from the Write() that tried to send it, along with 0, since
+// its data wasn't taken. Because it is impossible to tell when the
+// last write is, the Close() function should be called after all the
+// Write()s have been completed. This will cause the last write to be
+// handed to the handler. The returned byte slice will be sent along.
+//
+// By default, the handler isn't called if nothing was written and the
+// given writer isn't closed. The options change that. Calling Close()
+// again returns the same result and Write() after Close() returns
+// ErrClosed.
+func NewLastFuncWriter(handler func([]byte) []byte, w io.Writer,
+	opts ...LastWriterOption) io.WriteCloser {
+	if handler == nil {
+		return nil
+	}
+	return NewLastFuncWriterE(ignoreLastErr(handler), w, opts...)
+}
+
+// NewLastFuncWriterE is like NewLastFuncWriter except that the handler
+// can fail. If it returns an error, nothing more is written and Close()
+// returns the error. If either of the parameters are nil, nil is
+// returned.
+func NewLastFuncWriterE(handler func([]byte) ([]byte, error),
+	w io.Writer, opts ...LastWriterOption) io.WriteCloser {
 	if handler == nil || w == nil {
 		return nil
 	}
-	return &last{handler: handler, w: w}
+	l := &last{handler: handler, w: w}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
 }
@@ -5,7 +5,10 @@
 package wrapio
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/md5"
 	"crypto/sha256"
 	"encoding/hex"
@@ -39,6 +42,95 @@ func ExampleNewFuncReader() {
 	// This.is.the.sample.data.that.we.are.going.to.test.with.
 }
 
+func TestFuncReaderE(t *testing.T) {
+	bad := fmt.Errorf("found a z")
+	f := func(p []byte) error {
+		if bytes.IndexByte(p, 'z') >= 0 {
+			return bad
+		}
+		return nil
+	}
+	r := NewFuncReaderE(f, iotest.OneByteReader(strings.NewReader("abzcd")))
+	buf := make([]byte, 10)
+	expected := []struct {
+		data string
+		err  error
+	}{
+		{data: "a", err: nil},
+		{data: "b", err: nil},
+		{data: "z", err: bad},
+		{data: "", err: bad},
+	}
+	for x, e := range expected {
+		n, err := r.Read(buf)
+		if string(buf[:n]) != e.data || err != e.err {
+			t.Errorf("Test %v: got (%q, %v), expected (%q, %v)",
+				x, buf[:n], err, e.data, e.err)
+		}
+	}
+	// A hash should be able to sit on top of it.
+	m := md5.New()
+	hr := NewHashReader(m, NewFuncReaderE(f, strings.NewReader("this is a test.")))
+	if _, err := ioutil.ReadAll(hr); err != nil {
+		t.Errorf("unexpected error reading through hash: %v", err)
+	}
+	s := hex.EncodeToString(m.Sum(nil))
+	if s != "09cba091df696af91549de27b8e7d0f6" {
+		t.Errorf("unexpected Sum() through handler: %v", s)
+	}
+	// Test the special error cases.
+	if NewFuncReaderE(f, nil) != nil {
+		t.Errorf("nil io.Reader didn't return nil.")
+	}
+	if NewFuncReaderE(nil, strings.NewReader("")) != nil {
+		t.Errorf("nil func didn't return nil.")
+	}
+}
+
+func TestFuncWriterE(t *testing.T) {
+	bad := fmt.Errorf("found a z")
+	f := func(p []byte) error {
+		if bytes.IndexByte(p, 'z') >= 0 {
+			return bad
+		}
+		return nil
+	}
+	buf := &bytes.Buffer{}
+	s, sw := NewStatsWriter(NewFuncWriterE(f, buf))
+	tests := []struct {
+		data     string
+		n        int
+		err      error
+		expected string
+	}{
+		{data: "ab", n: 2, err: nil, expected: "ab"},
+		{data: "cz", n: 0, err: bad, expected: "ab"},
+		{data: "de", n: 0, err: bad, expected: "ab"},
+	}
+	for x, test := range tests {
+		n, err := sw.Write([]byte(test.data))
+		if n != test.n || err != test.err {
+			t.Errorf("Test %v: got (%v, %v), expected (%v, %v)",
+				x, n, err, test.n, test.err)
+		}
+		if buf.String() != test.expected {
+			t.Errorf("Test %v: written '%v', expected '%v'",
+				x, buf.String(), test.expected)
+		}
+	}
+	if snap := s.Snapshot(); snap.Calls != 1 || snap.ErrorCalls != 2 {
+		t.Errorf("stats calls %v/%v != expected %v/%v",
+			snap.Calls, snap.ErrorCalls, 1, 2)
+	}
+	// Test the special error cases.
+	if NewFuncWriterE(f, nil) != nil {
+		t.Errorf("nil io.Writer didn't return nil.")
+	}
+	if NewFuncWriterE(nil, ioutil.Discard) != nil {
+		t.Errorf("nil func didn't return nil.")
+	}
+}
+
 func ExampleNewHashReader() {
 	// We'll read from this using io.Copy.
 	r := strings.NewReader("This is the sample data that we are going to test with.")
@@ -129,6 +221,51 @@ func TestHashWriter(t *testing.T) {
 	}
 }
 
+func TestVerifyingHashReader(t *testing.T) {
+	data := "this is a test."
+	good, _ := hex.DecodeString("09cba091df696af91549de27b8e7d0f6")
+	bad, _ := hex.DecodeString("00cba091df696af91549de27b8e7d0f6")
+	// A matching digest reads just like normal.
+	buf := &bytes.Buffer{}
+	r := NewVerifyingHashReader(md5.New(), good, strings.NewReader(data))
+	if _, err := io.Copy(buf, r); err != nil {
+		t.Errorf("unexpected error with matching digest: %v", err)
+	}
+	if buf.String() != data {
+		t.Errorf("read '%v', expected '%v'", buf.String(), data)
+	}
+	// A different digest fails the copy.
+	r = NewVerifyingHashReader(md5.New(), bad, iotest.OneByteReader(strings.NewReader(data)))
+	_, err := io.Copy(ioutil.Discard, r)
+	dme, ok := err.(*DigestMismatchError)
+	if !ok {
+		t.Fatalf("expected a *DigestMismatchError, got %v", err)
+	}
+	if !bytes.Equal(dme.Expected, bad) || !bytes.Equal(dme.Actual, good) {
+		t.Errorf("unexpected digests in error: %v", dme)
+	}
+	// The error should stick.
+	if n, err := r.Read(make([]byte, 1)); n != 0 || err == nil {
+		t.Errorf("read after mismatch returned %v %v", n, err)
+	}
+	// Other errors are passed along untouched.
+	e := fmt.Errorf("i did it")
+	r = NewVerifyingHashReader(md5.New(), good, er{err: e})
+	if _, err := r.Read(make([]byte, 1)); err != e {
+		t.Errorf("err (%v) != expected (%v)", err, e)
+	}
+	// Test the special error cases.
+	if NewVerifyingHashReader(md5.New(), good, nil) != nil {
+		t.Errorf("nil io.Reader didn't return nil.")
+	}
+	if NewVerifyingHashReader(nil, good, strings.NewReader("")) != nil {
+		t.Errorf("nil hash didn't return nil.")
+	}
+	if NewVerifyingHashReader(md5.New(), nil, strings.NewReader("")) != nil {
+		t.Errorf("nil digest didn't return nil.")
+	}
+}
+
 func ExampleNewStatsReader() {
 	// We'll read from this using io.Copy.
 	sr := strings.NewReader("This is the sample data that we are going to test with.")
@@ -136,34 +273,33 @@ func ExampleNewStatsReader() {
 	s, r := NewStatsReader(iotest.OneByteReader(sr))
 	io.Copy(ioutil.Discard, r)
 	// Print out the statistics.
-	s.Lock()
-	defer s.Unlock()
-	fmt.Println(s)
+	fmt.Println(s.Snapshot())
 	// Output:
 	// [Total: 55, Average: 1.000000, Calls: 55]
 }
 
 func TestStatsString(t *testing.T) {
-	s := Stats{Total: 10, Average: 2.193, Calls: 5}
+	s := Snapshot{Total: 10, Average: 2.193, Calls: 5}
 	if s.String() != "[Total: 10, Average: 2.193000, Calls: 5]" {
-		t.Errorf("Stats.String() produced the wrong ouptut: %s", s)
+		t.Errorf("Snapshot.String() produced the wrong ouptut: %s", s)
 	}
 }
 
 func TestStatsReader(t *testing.T) {
 	tests := []struct {
 		data     string
-		expected Stats
+		expected Snapshot
 	}{
 		{
 			data:     "this is a test.",
-			expected: Stats{Total: 15, Average: 15, Calls: 1},
+			expected: Snapshot{Total: 15, Average: 15, Calls: 1},
 		},
 	}
 	for k, test := range tests {
 		sr := strings.NewReader(test.data)
-		s, hr := NewStatsReader(sr)
+		st, hr := NewStatsReader(sr)
 		ioutil.ReadAll(hr)
+		s := st.Snapshot()
 		if s.Total != test.expected.Total || s.Calls != test.expected.Calls ||
 			s.Average != test.expected.Average {
 			t.Errorf("Test %v: unexpected stats, got vs expected:\n%v\n%v",
@@ -175,17 +311,18 @@ func TestStatsReader(t *testing.T) {
 func TestStatsWriter(t *testing.T) {
 	tests := []struct {
 		data     string
-		expected Stats
+		expected Snapshot
 	}{
 		{
 			data:     "this is a test.",
-			expected: Stats{Total: 15, Average: 15, Calls: 1},
+			expected: Snapshot{Total: 15, Average: 15, Calls: 1},
 		},
 	}
 	for k, test := range tests {
 		sr := strings.NewReader(test.data)
-		s, hw := NewStatsWriter(ioutil.Discard)
+		st, hw := NewStatsWriter(ioutil.Discard)
 		io.Copy(hw, sr)
+		s := st.Snapshot()
 		if s.Total != test.expected.Total || s.Calls != test.expected.Calls ||
 			s.Average != test.expected.Average {
 			t.Errorf("Test %v: unexpected stats, got vs expected:\n%s\n%s",
@@ -308,6 +445,250 @@ func TestBlockWriter(t *testing.T) {
 	}
 }
 
+// recordWriter keeps a copy of every write and where it came from.
+type recordWriter struct {
+	writes [][]byte
+	addrs  []*byte
+}
+
+func (r *recordWriter) Write(p []byte) (int, error) {
+	r.writes = append(r.writes, append([]byte(nil), p...))
+	r.addrs = append(r.addrs, &p[0])
+	return len(p), nil
+}
+
+func TestBlockWriterNoCopy(t *testing.T) {
+	rw := &recordWriter{}
+	w := NewBlockWriter(4, rw, BlockPassThrough())
+	p := []byte("0123456789")
+	w.Write(p[:2])
+	w.Write(p[2:])
+	w.Close()
+	// The held "01" is topped up to a block, then "4567" goes through
+	// on its own and "89" is flushed on close.
+	expected := []string{"0123", "4567", "89"}
+	if len(rw.writes) != len(expected) {
+		t.Fatalf("got %v writes, expected %v", len(rw.writes), len(expected))
+	}
+	for x, e := range expected {
+		if string(rw.writes[x]) != e {
+			t.Errorf("write %v (%s) != expected (%s)", x, rw.writes[x], e)
+		}
+	}
+	if rw.addrs[1] != &p[4] {
+		t.Errorf("aligned data was copied")
+	}
+	// Holding on to partial blocks shouldn't grow the buffer.
+	b := w.(*block)
+	for x := 0; x < 100; x++ {
+		w.Write(p[:3])
+	}
+	if cap(b.buf) != 4 {
+		t.Errorf("buffer grew to %v", cap(b.buf))
+	}
+}
+
+func TestBlockWriterCopy(t *testing.T) {
+	// Without BlockPassThrough, a writer that changes its data in
+	// place, like a cipher, doesn't change the caller's slice.
+	buf := &bytes.Buffer{}
+	w := NewBlockWriter(4, NewFuncWriter(func(p []byte) {
+		for x := range p {
+			p[x] ^= 0xff
+		}
+	}, buf))
+	p := bytes.Repeat([]byte("0123456789"), 10000)
+	orig := append([]byte(nil), p...)
+	if n, err := w.Write(p); n != len(p) || err != nil {
+		t.Errorf("Write() returned %v %v", n, err)
+	}
+	w.Close()
+	if !bytes.Equal(p, orig) {
+		t.Errorf("the caller's data was changed")
+	}
+	if buf.Len() != len(orig) {
+		t.Fatalf("wrote %v bytes, expected %v", buf.Len(), len(orig))
+	}
+	for x, c := range buf.Bytes() {
+		if c != orig[x]^0xff {
+			t.Fatalf("byte %v (%v) != expected (%v)", x, c, orig[x]^0xff)
+		}
+	}
+	// Errors report what made it.
+	f := &failWriter{ok: 1, err: io.ErrShortWrite}
+	w = NewBlockWriter(4, f)
+	if n, err := w.Write(p); n != (blockCopySize/4)*4 || err != io.ErrShortWrite {
+		t.Errorf("failed Write() returned %v %v", n, err)
+	}
+}
+
+func TestBlockWriterReadFrom(t *testing.T) {
+	data := make([]byte, 100000)
+	for x := range data {
+		data[x] = byte(x)
+	}
+	for _, size := range []int{1, 7, 4096, 50000} {
+		for k, r := range []io.Reader{
+			bytes.NewReader(data),
+			iotest.HalfReader(bytes.NewReader(data)),
+			iotest.OneByteReader(bytes.NewReader(data)),
+		} {
+			buf := &bytes.Buffer{}
+			sizes := []int{}
+			w := NewBlockWriter(size, NewFuncWriter(func(p []byte) {
+				sizes = append(sizes, len(p))
+			}, buf))
+			// A held partial block has to come first.
+			w.Write(data[:3])
+			n, err := io.Copy(w, struct{ io.Reader }{r})
+			if n != int64(len(data)) || err != nil {
+				t.Errorf("Test %v(%v): io.Copy returned %v %v", size, k, n, err)
+			}
+			w.Close()
+			expected := append(append([]byte(nil), data[:3]...), data...)
+			if !bytes.Equal(buf.Bytes(), expected) {
+				t.Errorf("Test %v(%v): data didn't match", size, k)
+			}
+			for x, l := range sizes[:len(sizes)-1] {
+				if l%size != 0 {
+					t.Errorf("Test %v(%v): write %v wasn't whole blocks: %v",
+						size, k, x, l)
+				}
+			}
+		}
+	}
+	// Errors from the reader are returned and the data before it is
+	// kept.
+	buf := &bytes.Buffer{}
+	w := NewBlockWriter(4, buf)
+	e := fmt.Errorf("i did it")
+	n, err := w.(io.ReaderFrom).ReadFrom(er{n: 6, err: e})
+	if n != 6 || err != e || buf.Len() != 4 {
+		t.Errorf("bad reader error results: %v %v %v", n, err, buf.Len())
+	}
+	w.Close()
+	if buf.Len() != 6 {
+		t.Errorf("partial block was lost: %v", buf.Len())
+	}
+	// Errors from the writer stick.
+	w = NewBlockWriter(4, ew{err: e})
+	if _, err := io.Copy(w, strings.NewReader("0123456789")); err != e {
+		t.Errorf("bad writer error results: %v", err)
+	}
+	if _, err := w.Write([]byte("0123")); err != e {
+		t.Errorf("writer error didn't stick: %v", err)
+	}
+}
+
+// closeBuffer is a bytes.Buffer that counts calls to Close.
+type closeBuffer struct {
+	bytes.Buffer
+	closes int
+	err    error
+}
+
+func (c *closeBuffer) Close() error {
+	c.closes++
+	return c.err
+}
+
+func TestBlockWriterOptions(t *testing.T) {
+	var tail []byte
+	tailErr := fmt.Errorf("tail")
+	tests := []struct {
+		opts     []BlockWriterOption
+		data     string
+		expected string
+		tail     string
+		err      error
+		closes   int
+	}{
+		{data: "0123456", expected: "0123456"},
+		{data: "01234567", expected: "01234567"},
+		{
+			opts:     []BlockWriterOption{BlockPadTail(PKCS7Padding)},
+			data:     "0123456",
+			expected: "0123456\x01",
+		},
+		{
+			opts:     []BlockWriterOption{BlockPadTail(PKCS7Padding)},
+			data:     "0123",
+			expected: "0123\x04\x04\x04\x04",
+		},
+		{
+			opts:     []BlockWriterOption{BlockPadTail(NoPadding)},
+			data:     "0123",
+			expected: "0123",
+		},
+		{
+			opts:     []BlockWriterOption{BlockRejectPartial()},
+			data:     "0123456",
+			expected: "0123",
+			err:      ErrPartialBlock,
+		},
+		{
+			opts:     []BlockWriterOption{BlockRejectPartial()},
+			data:     "01234567",
+			expected: "01234567",
+		},
+		{
+			opts: []BlockWriterOption{BlockTailFunc(func(p []byte) error {
+				tail = append([]byte(nil), p...)
+				return tailErr
+			})},
+			data:     "0123456",
+			expected: "0123",
+			tail:     "456",
+			err:      tailErr,
+		},
+		{
+			opts:     []BlockWriterOption{BlockCloseWriter()},
+			data:     "0123456",
+			expected: "0123456",
+			closes:   1,
+		},
+		{
+			// The last tail option wins and the writer is closed even
+			// if there is an error.
+			opts: []BlockWriterOption{BlockPadTail(PKCS7Padding),
+				BlockRejectPartial(), BlockCloseWriter()},
+			data:     "0123456",
+			expected: "0123",
+			err:      ErrPartialBlock,
+			closes:   1,
+		},
+	}
+	for k, test := range tests {
+		tail = nil
+		cb := &closeBuffer{}
+		w := NewBlockWriter(4, cb, test.opts...)
+		io.WriteString(w, test.data)
+		for x := 0; x < 2; x++ {
+			if err := w.Close(); err != test.err {
+				t.Errorf("Test %v(%v): Close() (%v) != expected (%v)",
+					k, x, err, test.err)
+			}
+		}
+		if cb.String() != test.expected || string(tail) != test.tail ||
+			cb.closes != test.closes {
+			t.Errorf("Test %v: got %q %q %v, expected %q %q %v", k,
+				cb.String(), tail, cb.closes, test.expected, test.tail, test.closes)
+		}
+		if _, err := w.Write([]byte("0123")); err != ErrClosed {
+			t.Errorf("Test %v: Write() after Close() returned %v", k, err)
+		}
+		if _, err := io.Copy(w, strings.NewReader("0123")); err != ErrClosed {
+			t.Errorf("Test %v: io.Copy() after Close() returned %v", k, err)
+		}
+	}
+	// Errors from closing the writer are returned.
+	cb := &closeBuffer{err: fmt.Errorf("i did it")}
+	w := NewBlockWriter(4, cb, BlockCloseWriter())
+	if err := w.Close(); err != cb.err {
+		t.Errorf("close error (%v) != expected (%v)", err, cb.err)
+	}
+}
+
 func TestBlockReaderFunctional(t *testing.T) {
 	if NewBlockReader(0, er{}) != nil {
 		t.Errorf("zero reader size didn't return nil")
@@ -324,12 +705,99 @@ func TestBlockReaderFunctional(t *testing.T) {
 		t.Errorf("expected output '%v' != results '%v'",
 			"0123456789", buf.String())
 	}
-	if s.Calls != 2 {
+	if s.Snapshot().Calls != 2 {
 		t.Errorf("expected calls %v != results %v",
-			2, s.Calls)
+			2, s.Snapshot().Calls)
 	}
 }
 
+func TestBlockReaderSmallBuffer(t *testing.T) {
+	data := "0123456789"
+	for size := 1; size < 12; size++ {
+		for lp := 1; lp < 12; lp++ {
+			// The reader under the block reader should only ever be asked
+			// to fill whole blocks.
+			var bad []int
+			fr := NewFuncReader(func(p []byte) {}, strings.NewReader(data))
+			sizes := &sizeReader{r: fr}
+			br := NewBlockReader(size, sizes)
+			buf := &bytes.Buffer{}
+			p := make([]byte, lp)
+			var err error
+			var n int
+			for x := 0; err == nil && x < 100; x++ {
+				n, err = br.Read(p)
+				buf.Write(p[:n])
+			}
+			if err != io.EOF || buf.String() != data {
+				t.Errorf("size %v, len(p) %v: read '%v' %v, expected '%v' EOF",
+					size, lp, buf.String(), err, data)
+			}
+			for _, l := range sizes.lens {
+				if l%size != 0 {
+					bad = append(bad, l)
+				}
+			}
+			if len(bad) > 0 {
+				t.Errorf("size %v, len(p) %v: underlying reader given %v",
+					size, lp, bad)
+			}
+		}
+	}
+}
+
+func TestBlockReaderCBC(t *testing.T) {
+	key := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	b, _ := aes.NewCipher(key)
+	encrypt := func(lp int) []byte {
+		bm := cipher.NewCBCEncrypter(b, iv)
+		in := strings.NewReader("I eat pizza for breakfast and there is nothing you can do to stop me.")
+		last := NewLastFuncReader(func(p []byte) []byte {
+			for len(p)%aes.BlockSize != 0 {
+				p = append(p, 0)
+			}
+			return p
+		}, NewBlockReader(aes.BlockSize, in))
+		crypt := NewFuncReader(func(p []byte) {
+			bm.CryptBlocks(p, p)
+		}, last)
+		// Putting a block reader on top means crypt only ever sees
+		// whole blocks, whatever size we read with.
+		top := NewBlockReader(aes.BlockSize, crypt)
+		buf := &bytes.Buffer{}
+		p := make([]byte, lp)
+		for {
+			n, err := top.Read(p)
+			buf.Write(p[:n])
+			if err != nil {
+				break
+			}
+		}
+		return buf.Bytes()
+	}
+	expected := encrypt(4096)
+	if len(expected) != 80 {
+		t.Fatalf("unexpected cipher text length: %v", len(expected))
+	}
+	for _, lp := range []int{1, 5, 15, 17, 33} {
+		if ct := encrypt(lp); !bytes.Equal(ct, expected) {
+			t.Errorf("len(p) %v: cipher text differs:\n%x\n%x", lp, ct, expected)
+		}
+	}
+}
+
+// sizeReader records the length of each slice given to Read().
+type sizeReader struct {
+	r    io.Reader
+	lens []int
+}
+
+func (s *sizeReader) Read(p []byte) (int, error) {
+	s.lens = append(s.lens, len(p))
+	return s.r.Read(p)
+}
+
 // This does some unit testing. It puts the block in an artificial
 // state and checks the expected outcome.
 func TestBlockReaderUnitTest(t *testing.T) {
@@ -351,14 +819,35 @@ func TestBlockReaderUnitTest(t *testing.T) {
 			n:   0,
 			err: io.EOF,
 		},
-		// Test where len(p) is less than block size.
+		// Test where len(p) is less than block size. We stage a whole
+		// block and send part of it.
+		{
+			p:        make([]byte, 3),
+			expected: []byte{48, 49, 50},
+			block: block{
+				r: er{
+					data: []byte("0123"),
+					n:    4,
+					err:  nil,
+				},
+				size: 4,
+			},
+			buf: []byte("3"),
+			n:   3,
+			err: nil,
+		},
+		// The rest of a partially sent block goes out before anything
+		// else, even if p is big.
 		{
 			p:        make([]byte, 10),
-			expected: []byte{},
+			expected: []byte{51},
 			block: block{
-				size: 20,
+				buf:  []byte("34567"),
+				size: 4,
+				rem:  1,
 			},
-			n:   0,
+			buf: []byte("4567"),
+			n:   1,
 			err: nil,
 		},
 		// Test where we have an error, but still some in the buffer. We
@@ -407,15 +896,15 @@ func TestBlockReaderUnitTest(t *testing.T) {
 			expected: []byte{48, 49, 50, 51},
 			block: block{
 				r: er{
-					data: []byte("34567"),
-					n:    5,
+					data: []byte("3456"),
+					n:    4,
 					err:  nil,
 				},
 				buf:  []byte("012"),
 				size: 4,
 				err:  nil,
 			},
-			buf: []byte("4567"),
+			buf: []byte("456"),
 			n:   4,
 			err: nil,
 		},
@@ -620,6 +1109,51 @@ func TestLastFuncReader(t *testing.T) {
 	if NewLastFuncReader(nil, &bytes.Buffer{}) != nil {
 		t.Errorf("nil func did't return nil.")
 	}
+	if NewLastFuncReaderE(UnpadFunc(NoPadding, 1), nil) != nil {
+		t.Errorf("nil io.Reader didn't return nil.")
+	}
+	if NewLastFuncReaderE(nil, &bytes.Buffer{}) != nil {
+		t.Errorf("nil func did't return nil.")
+	}
+}
+
+func TestLastFuncReaderSizes(t *testing.T) {
+	data := make([]byte, 10000)
+	for x := range data {
+		data[x] = byte(x % 253)
+	}
+	extra := bytes.Repeat([]byte("!"), 5000)
+	expected := append(append([]byte(nil), data...), extra...)
+	for k, sizes := range [][]int{{1}, {3, 100, 1}, {4096, 7}, {1, 20000}, {9999}} {
+		for _, src := range []io.Reader{
+			bytes.NewReader(data),
+			iotest.HalfReader(bytes.NewReader(data)),
+			iotest.DataErrReader(bytes.NewReader(data)),
+		} {
+			calls := 0
+			// The handler returns more than any p can hold.
+			r := NewLastFuncReader(func(p []byte) []byte {
+				calls++
+				return append(p, extra...)
+			}, src)
+			got, err := readSizes(r, sizes)
+			if err != nil || !bytes.Equal(got, expected) || calls != 1 {
+				t.Errorf("Test %v: read %v bytes, %v, %v calls",
+					k, len(got), err, calls)
+			}
+		}
+	}
+	// bufio and io.Copy use their own sizes.
+	r := NewLastFuncReader(func(p []byte) []byte {
+		return append(p, extra...)
+	}, iotest.HalfReader(bytes.NewReader(data)))
+	br := bufio.NewReaderSize(r, 16)
+	br.ReadByte()
+	got := &bytes.Buffer{}
+	io.Copy(got, br)
+	if !bytes.Equal(got.Bytes(), expected[1:]) {
+		t.Errorf("bufio read %v bytes, expected %v", got.Len(), len(expected)-1)
+	}
 }
 
 func TestLastFuncWriter(t *testing.T) {
@@ -680,6 +1214,137 @@ func TestLastFuncWriter(t *testing.T) {
 	if NewLastFuncWriter(nil, ioutil.Discard) != nil {
 		t.Errorf("nil func did't return nil.")
 	}
+	if NewLastFuncWriterE(UnpadFunc(NoPadding, 1), nil) != nil {
+		t.Errorf("nil io.Writer didn't return nil.")
+	}
+	if NewLastFuncWriterE(nil, ioutil.Discard) != nil {
+		t.Errorf("nil func did't return nil.")
+	}
+}
+
+// failWriter fails every write after the first ok ones.
+type failWriter struct {
+	bytes.Buffer
+	ok  int
+	err error
+}
+
+func (f *failWriter) Write(p []byte) (int, error) {
+	if f.ok == 0 {
+		return 0, f.err
+	}
+	f.ok--
+	return f.Buffer.Write(p)
+}
+
+func TestLastFuncWriterErrors(t *testing.T) {
+	e := fmt.Errorf("i did it")
+	trailer := func(p []byte) []byte {
+		return append(p, "|trailer"...)
+	}
+	// The error comes back from the Write() that caused it.
+	fw := &failWriter{ok: 1, err: e}
+	w := NewLastFuncWriter(trailer, fw)
+	for x, expected := range []error{nil, nil, e, e} {
+		expectedN := 3
+		if expected != nil {
+			expectedN = 0
+		}
+		if n, err := w.Write([]byte("abc")); n != expectedN || err != expected {
+			t.Errorf("Write %v returned %v %v, expected %v %v",
+				x, n, err, expectedN, expected)
+		}
+	}
+	if err := w.Close(); err != e || fw.String() != "abc" {
+		t.Errorf("Close() returned %v and wrote %q", err, fw.String())
+	}
+	// Empty writes don't replace the last one.
+	buf := &closeBuffer{}
+	w = NewLastFuncWriter(trailer, buf)
+	w.Write([]byte("abc"))
+	w.Write(nil)
+	w.Close()
+	if buf.String() != "abc|trailer" {
+		t.Errorf("empty write replaced the last: %q", buf.String())
+	}
+	// Empty streams only run the handler when asked to and closing is
+	// passed along when asked to.
+	tests := []struct {
+		opts     []LastWriterOption
+		expected string
+		closes   int
+	}{
+		{},
+		{opts: []LastWriterOption{LastRunOnEmpty()}, expected: "|trailer"},
+		{opts: []LastWriterOption{LastCloseWriter()}, closes: 1},
+		{opts: []LastWriterOption{LastRunOnEmpty(), LastCloseWriter()},
+			expected: "|trailer", closes: 1},
+	}
+	for k, test := range tests {
+		buf := &closeBuffer{}
+		w := NewLastFuncWriter(trailer, buf, test.opts...)
+		for x := 0; x < 2; x++ {
+			if err := w.Close(); err != nil {
+				t.Errorf("Test %v(%v): Close() returned %v", k, x, err)
+			}
+		}
+		if buf.String() != test.expected || buf.closes != test.closes {
+			t.Errorf("Test %v: got %q %v, expected %q %v",
+				k, buf.String(), buf.closes, test.expected, test.closes)
+		}
+		if _, err := w.Write([]byte("abc")); err != ErrClosed {
+			t.Errorf("Test %v: Write() after Close() returned %v", k, err)
+		}
+	}
+	// Handler and close errors are returned and the writer is still
+	// closed.
+	buf = &closeBuffer{err: fmt.Errorf("close")}
+	w = NewLastFuncWriterE(func([]byte) ([]byte, error) {
+		return nil, e
+	}, buf, LastCloseWriter())
+	w.Write([]byte("abc"))
+	if err := w.Close(); err != e || buf.closes != 1 || buf.Len() != 0 {
+		t.Errorf("handler error: %v %v %q", err, buf.closes, buf.String())
+	}
+	w = NewLastFuncWriter(trailer, buf, LastCloseWriter())
+	if err := w.Close(); err != buf.err {
+		t.Errorf("close error (%v) != expected (%v)", err, buf.err)
+	}
+}
+
+func TestLastFuncWriterHoldBack(t *testing.T) {
+	rw := &recordWriter{}
+	w := NewLastFuncWriter(func(p []byte) []byte {
+		return append(p, '|')
+	}, rw, LastHoldBack(3))
+	p := []byte("0123456789")
+	w.Write(p[:2])
+	w.Write(p[2:])
+	w.Close()
+	// Only the last 3 bytes of each write are held, and the rest goes
+	// through without being copied.
+	expected := []string{"01", "23456", "789|"}
+	if len(rw.writes) != len(expected) {
+		t.Fatalf("got %q, expected %q", rw.writes, expected)
+	}
+	for x, e := range expected {
+		if string(rw.writes[x]) != e {
+			t.Errorf("Write %v: got %q, expected %q", x, rw.writes[x], e)
+		}
+	}
+	if rw.addrs[1] != &p[2] {
+		t.Errorf("data before the held part was copied")
+	}
+	// An error sending the data is returned and sticks.
+	e := fmt.Errorf("i did it")
+	w = NewLastFuncWriter(func(p []byte) []byte { return p },
+		&failWriter{err: e}, LastHoldBack(3))
+	if n, err := w.Write(p); n != 0 || err != e {
+		t.Errorf("failed write returned %v %v", n, err)
+	}
+	if err := w.Close(); err != e {
+		t.Errorf("Close() returned %v", err)
+	}
 }
 
 // Er is a helper for testing reads. It always writes the given data